@@ -2,23 +2,39 @@ package prxycfg
 
 import (
 	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	univcfg "github.com/fmgornick/dynamic-proxy/app/config/universal"
 
+	proto "google.golang.org/protobuf/proto"
 	anypb "google.golang.org/protobuf/types/known/anypb"
 	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	structpb "google.golang.org/protobuf/types/known/structpb"
 	wpb "google.golang.org/protobuf/types/known/wrapperspb"
 
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	mutationrules "github.com/envoyproxy/go-control-plane/envoy/config/common/mutation_rules/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	ratelimitcfg "github.com/envoyproxy/go-control-plane/envoy/config/ratelimit/v3"
+	rbac "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	corsfilter "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	localrl "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	ratelimitfilter "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ratelimit/v3"
+	rbacfilter "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
 	router "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	headermutation "github.com/envoyproxy/go-control-plane/envoy/extensions/http/early_header_mutation/header_mutation/v3"
 	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	wellknown "github.com/envoyproxy/go-control-plane/pkg/wellknown"
 )
@@ -31,11 +47,36 @@ var clusterPolicy = map[string]int32{
 	"maglev":           5,
 	"cluster_provided": 6,
 	"lb_policy_config": 7,
+	// envoy has no fill first policy, the processor gives each endpoint its own priority instead
+	"first": 0,
 }
 
+var redirectCodes = map[uint]route.RedirectAction_RedirectResponseCode{
+	301: route.RedirectAction_MOVED_PERMANENTLY,
+	302: route.RedirectAction_FOUND,
+	303: route.RedirectAction_SEE_OTHER,
+	307: route.RedirectAction_TEMPORARY_REDIRECT,
+	308: route.RedirectAction_PERMANENT_REDIRECT,
+}
+
+// name of the local rate limit http filter, also used as the key for per route rate limit config
+const localRateLimit = "envoy.filters.http.local_ratelimit"
+const localRateLimitStatPrefix = "http_local_rate_limiter"
+
+// header the client's api key is read from when rate limiting on "api-key"
+const apiKeyHeader = "x-api-key"
+
+// global rate limit service, used for limits keyed on a field so each value gets its own bucket
+const RateLimitCluster = "ratelimit_service"
+const rateLimitDomain = "dynamic-proxy"
+
+// metadata key envoy looks up when picking an endpoint's transport socket
+const transportSocketMatch = "envoy.transport_socket_match"
+
 var httpsPorts = map[string]uint{
-	"internal": 48877,
-	"external": 48878,
+	"internal":     48877,
+	"external":     48878,
+	"gcp-external": 48879,
 }
 
 // create listener envoyproxy configuration
@@ -52,37 +93,88 @@ func MakeHTTPSListener(l *univcfg.Listener, hasHttp bool) *listener.Listener {
 	}
 
 	routerpb, _ := anypb.New(&router.Router{})
-	manager, _ := anypb.New(&hcm.HttpConnectionManager{
-		CodecType:  hcm.HttpConnectionManager_AUTO,
-		StatPrefix: "https",
-		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
-			Rds: &hcm.Rds{
-				ConfigSource: &core.ConfigSource{
-					ResourceApiVersion: resource.DefaultAPIVersion,
-					ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
-						ApiConfigSource: &core.ApiConfigSource{
-							TransportApiVersion:       resource.DefaultAPIVersion,
-							ApiType:                   core.ApiConfigSource_GRPC,
-							SetNodeOnFirstMessageOnly: true,
-							GrpcServices: []*core.GrpcService{{
-								TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
-									EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: "xds_cluster"},
-								},
-							}},
-						},
-					},
-				},
-				// link internal listener to internal route configuration
-				RouteConfigName: l.Name + "-routes",
+	corspb, _ := anypb.New(&corsfilter.Cors{})
+	ratelimitpb, _ := anypb.New(&localrl.LocalRateLimit{StatPrefix: localRateLimitStatPrefix})
+	rbacpb, _ := anypb.New(&rbacfilter.RBAC{})
+	filters := []*hcm.HttpFilter{
+		{
+			// answers preflight requests before they can be turned away for missing groups or rate limits
+			// routes without a cors policy aren't affected
+			Name: wellknown.CORS,
+			ConfigType: &hcm.HttpFilter_TypedConfig{
+				TypedConfig: corspb,
 			},
 		},
-		HttpFilters: []*hcm.HttpFilter{{
-			Name: wellknown.Router,
+		{
+			// no rules means no enforcement, routes with groups add their own policy
+			Name: wellknown.HTTPRoleBasedAccessControl,
 			ConfigType: &hcm.HttpFilter_TypedConfig{
-				TypedConfig: routerpb,
+				TypedConfig: rbacpb,
 			},
-		}},
+		},
+		{
+			// disabled by default, routes with a rate limit on the whole route turn it on in their per filter config
+			Name: localRateLimit,
+			ConfigType: &hcm.HttpFilter_TypedConfig{
+				TypedConfig: ratelimitpb,
+			},
+		},
+	}
+	if l.RateLimits {
+		// routes with a limit keyed on a field send their descriptors to the rate limit service
+		filters = append(filters, &hcm.HttpFilter{
+			Name: wellknown.HTTPRateLimit,
+			ConfigType: &hcm.HttpFilter_TypedConfig{
+				TypedConfig: globalRateLimitConfig(),
+			},
+		})
+	}
+	filters = append(filters, &hcm.HttpFilter{
+		Name: wellknown.Router,
+		ConfigType: &hcm.HttpFilter_TypedConfig{
+			TypedConfig: routerpb,
+		},
+	})
+	manager := func(stripGroups bool) *listener.Filter {
+		config := &hcm.HttpConnectionManager{
+			CodecType:  hcm.HttpConnectionManager_AUTO,
+			StatPrefix: "https",
+			RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+				Rds: &hcm.Rds{
+					ConfigSource: xdsConfigSource(),
+					// link internal listener to internal route configuration
+					RouteConfigName: l.Name + "-routes",
+				},
+			},
+			HttpFilters: filters,
+		}
+		if stripGroups {
+			config.EarlyHeaderMutationExtensions = []*core.TypedExtensionConfig{removeHeader(l.GroupsHeader)}
+		}
+		managerpb, _ := anypb.New(config)
+		return &listener.Filter{
+			Name: wellknown.HTTPConnectionManager,
+			ConfigType: &listener.Filter_TypedConfig{
+				TypedConfig: managerpb,
+			},
+		}
+	}
+
+	// the groups header is only believed from trusted hops, everyone else has it removed before any route sees it
+	var chains []*listener.FilterChain
+	if l.GroupsHeader != "" && len(l.GroupsTrustedCidrs) != 0 {
+		chains = append(chains, &listener.FilterChain{
+			Name:             "trusted",
+			FilterChainMatch: &listener.FilterChainMatch{DirectSourcePrefixRanges: cidrRanges(l.GroupsTrustedCidrs)},
+			Filters:          []*listener.Filter{manager(false)},
+			TransportSocket:  transportSocket(downstreamTlsContext(l.CommonName)),
+		})
+	}
+	chains = append(chains, &listener.FilterChain{
+		Filters:         []*listener.Filter{manager(l.GroupsHeader != "")},
+		TransportSocket: transportSocket(downstreamTlsContext(l.CommonName)),
 	})
+
 	return &listener.Listener{
 		Name: "https-" + l.Name,
 		Address: &core.Address{
@@ -94,18 +186,40 @@ func MakeHTTPSListener(l *univcfg.Listener, hasHttp bool) *listener.Listener {
 				},
 			},
 		},
-		FilterChains: []*listener.FilterChain{{
-			Filters: []*listener.Filter{{
-				Name: wellknown.HTTPConnectionManager,
-				ConfigType: &listener.Filter_TypedConfig{
-					TypedConfig: manager,
-				},
-			}},
-			TransportSocket: transportSocket(l.CommonName),
+		FilterChains: chains,
+	}
+}
+
+// helper: early header mutation removing a header, before routing or any http filter gets to see it
+func removeHeader(name string) *core.TypedExtensionConfig {
+	mutation, _ := anypb.New(&headermutation.HeaderMutation{
+		Mutations: []*mutationrules.HeaderMutation{{
+			Action: &mutationrules.HeaderMutation_Remove{Remove: name},
 		}},
+	})
+	return &core.TypedExtensionConfig{
+		Name:        "envoy.http.early_header_mutation.header_mutation",
+		TypedConfig: mutation,
 	}
 }
 
+// helper: turn "address/length" strings into cidr ranges, they're checked when the flags are read
+func cidrRanges(cidrs []string) []*core.CidrRange {
+	var ranges []*core.CidrRange
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		length, _ := network.Mask.Size()
+		ranges = append(ranges, &core.CidrRange{
+			AddressPrefix: network.IP.String(),
+			PrefixLen:     wpb.UInt32(uint32(length)),
+		})
+	}
+	return ranges
+}
+
 func MakeHTTPListener(l *univcfg.Listener) []*listener.Listener {
 	routerpb, _ := anypb.New(&router.Router{})
 	manager, _ := anypb.New(&hcm.HttpConnectionManager{
@@ -168,56 +282,152 @@ func MakeHTTPListener(l *univcfg.Listener) []*listener.Listener {
 	return []*listener.Listener{http_listener, https_listener}
 }
 
+// helper: config source pointing back at this program's xds server
+func xdsConfigSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ResourceApiVersion: resource.DefaultAPIVersion,
+		ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
+			ApiConfigSource: &core.ApiConfigSource{
+				TransportApiVersion:       resource.DefaultAPIVersion,
+				ApiType:                   core.ApiConfigSource_GRPC,
+				SetNodeOnFirstMessageOnly: true,
+				GrpcServices: []*core.GrpcService{{
+					TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+						EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: "xds_cluster"},
+					},
+				}},
+			},
+		},
+	}
+}
+
 // create cluster envoyproxy configuration
 // TODO: find a way to get hostname for healthcheck
-func MakeCluster(c *univcfg.Cluster, https bool) *cluster.Cluster {
+func MakeCluster(c *univcfg.Cluster, eds bool) *cluster.Cluster {
 	cluster := &cluster.Cluster{
 		Name:           c.Name,
-		ConnectTimeout: durationpb.New(5 * time.Second),
-		// strict DNS is the only one that does multiple endpoints + ips or domains
-		// logical DNS only does 1 enpoint
-		// eds config only does IPs
-		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_STRICT_DNS},
-		LbPolicy:             cluster.Cluster_LbPolicy(clusterPolicy[c.Policy]),
+		ConnectTimeout: durationpb.New(connectTimeout(c.ConnectTimeout)),
+		LbPolicy:       cluster.Cluster_LbPolicy(clusterPolicy[c.Policy]),
 	}
-	if https {
-		cluster.TransportSocket = transportSocket()
+	setDiscoveryType(cluster, c.DnsType, eds)
+	if c.Tls != nil {
+		cluster.TransportSocketMatches = transportSocketMatches(c.Tls)
+		if c.Tls.AutoSni {
+			cluster.TypedExtensionProtocolOptions = autoSniOptions(c.Tls)
+		}
 	}
 	if c.HealthCheck != nil {
-		cluster.HealthChecks = []*core.HealthCheck{{
-			Timeout:            &durationpb.Duration{Seconds: int64(5)},
-			Interval:           &durationpb.Duration{Seconds: int64(c.HealthCheck.Interval)},
-			UnhealthyThreshold: &wpb.UInt32Value{Value: uint32(c.HealthCheck.Unhealthy)},
-			HealthyThreshold:   &wpb.UInt32Value{Value: uint32(c.HealthCheck.Healthy)},
-			HealthChecker:      &core.HealthCheck_HttpHealthCheck_{},
-		}}
-		if c.HealthCheck.Type == "http" {
-			if c.HealthCheck.Host == "" {
-				cluster.HealthChecks[0].HealthChecker = &core.HealthCheck_HttpHealthCheck_{
-					HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{
-						Path: c.HealthCheck.Path,
-					},
-				}
-			} else {
-				cluster.HealthChecks[0].HealthChecker = &core.HealthCheck_HttpHealthCheck_{
-					HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{
-						Path: c.HealthCheck.Path,
-						Host: c.HealthCheck.Host,
-					},
-				}
-			}
-		} else {
-			cluster.HealthChecks[0].HealthChecker = &core.HealthCheck_TcpHealthCheck_{
-				TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
-			}
+		cluster.HealthChecks = []*core.HealthCheck{MakeHealthCheck(c.HealthCheck)}
+	}
+	if c.CircuitBreaker != nil {
+		cluster.CircuitBreakers = circuitBreakers(c.CircuitBreaker)
+	}
+	if c.OutlierDetection != nil {
+		cluster.OutlierDetection = outlierDetection(c.OutlierDetection)
+	}
+	return cluster
+}
+
+// helper: create circuit breaker envoyproxy configuration, limits of 0 are left to envoy's defaults
+func circuitBreakers(cb *univcfg.CircuitBreaker) *cluster.CircuitBreakers {
+	threshold := &cluster.CircuitBreakers_Thresholds{
+		Priority:           core.RoutingPriority_DEFAULT,
+		MaxConnections:     optionalUInt32(cb.MaxConnections),
+		MaxPendingRequests: optionalUInt32(cb.MaxPendingRequests),
+		MaxRequests:        optionalUInt32(cb.MaxRequests),
+		MaxRetries:         optionalUInt32(cb.MaxRetries),
+	}
+	return &cluster.CircuitBreakers{
+		Thresholds: []*cluster.CircuitBreakers_Thresholds{threshold},
+	}
+}
+
+// helper: create outlier detection envoyproxy configuration, fields of 0 are left to envoy's defaults
+func outlierDetection(od *univcfg.OutlierDetection) *cluster.OutlierDetection {
+	outlier := &cluster.OutlierDetection{
+		Consecutive_5Xx:    optionalUInt32(od.Consecutive5xx),
+		MaxEjectionPercent: optionalUInt32(od.MaxEjectionPercent),
+	}
+	if od.EjectionTime != 0 {
+		outlier.BaseEjectionTime = durationpb.New(od.EjectionTime)
+	}
+	return outlier
+}
+
+// helper: wrap a value for envoy, leaving it unset if it's 0
+func optionalUInt32(value uint) *wpb.UInt32Value {
+	if value == 0 {
+		return nil
+	}
+	return wpb.UInt32(uint32(value))
+}
+
+// helper: decide how a cluster finds its endpoints
+// eds only does IPs, but endpoints can change without touching the cluster
+// strict DNS does multiple endpoints + ips or domains
+// logical DNS only does 1 enpoint, but doesn't drop connections when the dns answer changes
+func setDiscoveryType(c *cluster.Cluster, dnsType string, eds bool) {
+	switch {
+	case eds:
+		c.ClusterDiscoveryType = &cluster.Cluster_Type{Type: cluster.Cluster_EDS}
+		c.EdsClusterConfig = &cluster.Cluster_EdsClusterConfig{EdsConfig: xdsConfigSource()}
+	case dnsType == "logical":
+		c.ClusterDiscoveryType = &cluster.Cluster_Type{Type: cluster.Cluster_LOGICAL_DNS}
+	default:
+		c.ClusterDiscoveryType = &cluster.Cluster_Type{Type: cluster.Cluster_STRICT_DNS}
+	}
+}
+
+// helper: clusters wait 5 seconds to connect unless told otherwise
+func connectTimeout(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return 5 * time.Second
+	}
+	return timeout
+}
+
+// create health check envoyproxy configuration
+func MakeHealthCheck(hc *univcfg.HealthCheck) *core.HealthCheck {
+	healthCheck := &core.HealthCheck{
+		Timeout:            durationpb.New(hc.Timeout),
+		Interval:           durationpb.New(hc.Interval),
+		UnhealthyThreshold: &wpb.UInt32Value{Value: uint32(hc.Unhealthy)},
+		HealthyThreshold:   &wpb.UInt32Value{Value: uint32(hc.Healthy)},
+	}
+	if hc.Type != "http" {
+		healthCheck.HealthChecker = &core.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
 		}
+		return healthCheck
+	}
 
+	codec := typev3.CodecClientType_HTTP1
+	if hc.Version == "HTTP/2" {
+		codec = typev3.CodecClientType_HTTP2
 	}
-	return cluster
+	// envoy's ranges don't include the end value
+	var statuses []*typev3.Int64Range
+	for _, status := range hc.ExpectedStatuses {
+		statuses = append(statuses, &typev3.Int64Range{
+			Start: int64(status.Start),
+			End:   int64(status.End) + 1,
+		})
+	}
+	healthCheck.HealthChecker = &core.HealthCheck_HttpHealthCheck_{
+		HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{
+			Host:             hc.Host,
+			Path:             hc.Path,
+			Method:           core.RequestMethod(core.RequestMethod_value[hc.Method]),
+			CodecClientType:  codec,
+			ExpectedStatuses: statuses,
+		},
+	}
+	return healthCheck
 }
 
 // create route envoyproxy configuration
-func MakeRoute(r *univcfg.Route) *route.Route {
+// the listener decides how callers prove which groups they're in
+func MakeRoute(r *univcfg.Route, l *univcfg.Listener) (*route.Route, error) {
 	// if we only care about the start of the path then we use the prefix match
 	// if we care about the whole path then we use the path match
 	action := &route.Route_Route{
@@ -230,42 +440,258 @@ func MakeRoute(r *univcfg.Route) *route.Route {
 			},
 		},
 	}
+	var match *route.RouteMatch
 	switch r.Type {
 	case "starts_with":
-		return &route.Route{
-			Name: r.ClusterName,
-			Match: &route.RouteMatch{
-				PathSpecifier: &route.RouteMatch_Prefix{
-					Prefix: r.Path,
-				},
+		match = &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{
+				Prefix: r.Path,
 			},
-			Action: action,
 		}
 	case "exact":
-		return &route.Route{
-			Name: r.ClusterName,
-			Match: &route.RouteMatch{
-				PathSpecifier: &route.RouteMatch_Path{
-					Path: r.Path,
-				},
+		match = &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Path{
+				Path: r.Path,
 			},
-			Action: action,
 		}
 	case "regex":
-		return &route.Route{
-			Name: r.ClusterName,
-			Match: &route.RouteMatch{
-				PathSpecifier: &route.RouteMatch_SafeRegex{
-					SafeRegex: &matcher.RegexMatcher{
-						EngineType: &matcher.RegexMatcher_GoogleRe2{},
-						Regex:      r.Path,
-					},
+		match = &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_SafeRegex{
+				SafeRegex: &matcher.RegexMatcher{
+					EngineType: &matcher.RegexMatcher_GoogleRe2{},
+					Regex:      r.Path,
 				},
 			},
-			Action: action,
 		}
 	default:
-		panic(fmt.Errorf("invalid path type in clustername: %s", r.ClusterName))
+		return nil, fmt.Errorf("invalid path type in clustername: %s", r.ClusterName)
+	}
+
+	match.Headers = headerMatchers(r.Headers, r.Methods)
+	match.QueryParameters = queryParamMatchers(r.QueryParams)
+	pathRewrite(action.Route, r)
+	if len(r.Splits) != 0 {
+		action.Route.ClusterSpecifier = weightedClusters(r.Splits)
+	}
+	if r.HashPolicy != nil {
+		policy, err := hashPolicy(r.HashPolicy)
+		if err != nil {
+			return nil, err
+		}
+		action.Route.HashPolicy = policy
+	}
+	if r.Timeout != 0 {
+		action.Route.Timeout = durationpb.New(r.Timeout)
+	}
+	if r.IdleTimeout != 0 {
+		action.Route.IdleTimeout = durationpb.New(r.IdleTimeout)
+	}
+	if r.Retry != nil {
+		action.Route.RetryPolicy = retryPolicy(r.Retry)
+	}
+
+	rt := &route.Route{
+		Name:   r.ClusterName,
+		Match:  match,
+		Action: action,
+	}
+	rt.RequestHeadersToAdd = headersToAdd(r.HeaderRules.Request)
+	rt.RequestHeadersToRemove = r.HeaderRules.Request.Remove
+	rt.ResponseHeadersToAdd = headersToAdd(r.HeaderRules.Response)
+	rt.ResponseHeadersToRemove = r.HeaderRules.Response.Remove
+	rt.TypedPerFilterConfig = make(map[string]*anypb.Any)
+	// the rate limit service is only asked about routes that reach a cluster, so routes answering
+	// requests themselves fall back to a local bucket shared by every client
+	if r.RateLimit != nil && r.RateLimit.PerKey() && r.Direct == nil && r.Redirect == nil {
+		action.Route.RateLimits = rateLimitActions(r.RateLimit, r.ClusterName)
+	} else if r.RateLimit != nil {
+		rt.TypedPerFilterConfig[localRateLimit] = localRateLimitConfig(r.RateLimit)
+	}
+	if r.Cors != nil {
+		rt.TypedPerFilterConfig[wellknown.CORS] = corsConfig(r.Cors)
+	}
+	if len(r.Groups) != 0 && l.GroupsHeader != "" {
+		rt.TypedPerFilterConfig[wellknown.HTTPRoleBasedAccessControl] = rbacConfig(r.Groups, l.GroupsHeader)
+	}
+
+	// routes that answer requests themselves never reach a cluster
+	if r.Direct != nil {
+		rt.Action = &route.Route_DirectResponse{
+			DirectResponse: &route.DirectResponseAction{
+				Status: uint32(r.Direct.Status),
+				Body: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{InlineString: r.Direct.Body},
+				},
+			},
+		}
+	} else if r.Redirect != nil {
+		rt.Action = &route.Route_Redirect{Redirect: redirectAction(r.Redirect)}
+	}
+	return rt, nil
+}
+
+// helper: create redirect envoyproxy configuration
+func redirectAction(r *univcfg.Redirect) *route.RedirectAction {
+	redirect := &route.RedirectAction{
+		HostRedirect: r.Host,
+		PortRedirect: uint32(r.Port),
+		ResponseCode: redirectCodes[r.Status],
+	}
+	if r.Scheme != "" {
+		redirect.SchemeRewriteSpecifier = &route.RedirectAction_SchemeRedirect{SchemeRedirect: r.Scheme}
+	}
+	if r.Path != "" {
+		redirect.PathRewriteSpecifier = &route.RedirectAction_PathRedirect{PathRedirect: r.Path}
+	} else if r.Prefix != "" {
+		redirect.PathRewriteSpecifier = &route.RedirectAction_PrefixRewrite{PrefixRewrite: r.Prefix}
+	}
+	return redirect
+}
+
+// helper: create hash policy envoyproxy configuration, tells hash based clusters what to hash
+func hashPolicy(h *univcfg.HashPolicy) ([]*route.RouteAction_HashPolicy, error) {
+	var policy *route.RouteAction_HashPolicy
+	switch h.Type {
+	case "source_ip":
+		policy = &route.RouteAction_HashPolicy{PolicySpecifier: &route.RouteAction_HashPolicy_ConnectionProperties_{
+			ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{SourceIp: true},
+		}}
+	case "path":
+		policy = &route.RouteAction_HashPolicy{PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+			Header: &route.RouteAction_HashPolicy_Header{HeaderName: ":path"},
+		}}
+	case "header":
+		policy = &route.RouteAction_HashPolicy{PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+			Header: &route.RouteAction_HashPolicy_Header{HeaderName: h.Name},
+		}}
+	case "query_param":
+		policy = &route.RouteAction_HashPolicy{PolicySpecifier: &route.RouteAction_HashPolicy_QueryParameter_{
+			QueryParameter: &route.RouteAction_HashPolicy_QueryParameter{Name: h.Name},
+		}}
+	case "cookie":
+		policy = &route.RouteAction_HashPolicy{PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{
+			Cookie: &route.RouteAction_HashPolicy_Cookie{Name: h.Name},
+		}}
+	default:
+		return nil, fmt.Errorf("invalid hash policy type: %s", h.Type)
+	}
+	return []*route.RouteAction_HashPolicy{policy}, nil
+}
+
+// per route cors config, picked up by the http connection manager's cors filter
+func corsConfig(cors *univcfg.CorsPolicy) *anypb.Any {
+	policy := &corsfilter.CorsPolicy{
+		AllowMethods:     strings.Join(cors.AllowMethods, ","),
+		AllowHeaders:     strings.Join(cors.AllowHeaders, ","),
+		ExposeHeaders:    strings.Join(cors.ExposeHeaders, ","),
+		AllowCredentials: wpb.Bool(cors.AllowCredentials),
+	}
+	for _, origin := range cors.AllowOrigins {
+		policy.AllowOriginStringMatch = append(policy.AllowOriginStringMatch, stringMatcher(origin.Type, origin.Value))
+	}
+	if cors.MaxAge != 0 {
+		policy.MaxAge = strconv.Itoa(int(cors.MaxAge.Seconds()))
+	}
+	ctx, _ := anypb.New(policy)
+	return ctx
+}
+
+// helper: send a share of the route's traffic to each cluster
+func weightedClusters(splits []univcfg.WeightedCluster) *route.RouteAction_WeightedClusters {
+	var clusters []*route.WeightedCluster_ClusterWeight
+	for _, split := range splits {
+		clusters = append(clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   split.Name,
+			Weight: wpb.UInt32(uint32(split.Weight)),
+		})
+	}
+	return &route.RouteAction_WeightedClusters{
+		WeightedClusters: &route.WeightedCluster{
+			Clusters: clusters,
+		},
+	}
+}
+
+// helper: create retry policy envoyproxy configuration
+func retryPolicy(retry *univcfg.RetryPolicy) *route.RetryPolicy {
+	policy := &route.RetryPolicy{
+		RetryOn:    strings.Join(retry.On, ","),
+		NumRetries: wpb.UInt32(uint32(retry.Count)),
+	}
+	if retry.PerTryTimeout != 0 {
+		policy.PerTryTimeout = durationpb.New(retry.PerTryTimeout)
+	}
+	return policy
+}
+
+// helper: set the prefix or regex rewrite of a route action
+func pathRewrite(action *route.RouteAction, r *univcfg.Route) {
+	if r.RegexRewrite != nil {
+		action.RegexRewrite = &matcher.RegexMatchAndSubstitute{
+			Pattern: &matcher.RegexMatcher{
+				EngineType: &matcher.RegexMatcher_GoogleRe2{},
+				Regex:      r.RegexRewrite.Pattern,
+			},
+			Substitution: r.RegexRewrite.Substitution,
+		}
+		return
+	}
+	if r.PrefixRewrite == "" {
+		return
+	}
+	// swapping "/api" for "/" would turn "/api/cars" into "//cars", so strip the prefix and any slashes after it instead
+	if r.PrefixRewrite == "/" && r.Type == "starts_with" && !strings.HasSuffix(r.Path, "/") {
+		action.RegexRewrite = &matcher.RegexMatchAndSubstitute{
+			Pattern: &matcher.RegexMatcher{
+				EngineType: &matcher.RegexMatcher_GoogleRe2{},
+				Regex:      "^" + regexp.QuoteMeta(r.Path) + "/*",
+			},
+			Substitution: "/",
+		}
+		return
+	}
+	action.PrefixRewrite = r.PrefixRewrite
+}
+
+// create virtual host envoyproxy configuration holding all of a listener's routes
+// the listener's header changes are made after the route's, so they win if both touch the same header
+func MakeVirtualHost(l *univcfg.Listener, routes []*route.Route) *route.VirtualHost {
+	return &route.VirtualHost{
+		Name:                    l.Name + "-routes",
+		Domains:                 []string{"*"},
+		Routes:                  routes,
+		RequestHeadersToAdd:     headersToAdd(l.HeaderRules.Request),
+		RequestHeadersToRemove:  l.HeaderRules.Request.Remove,
+		ResponseHeadersToAdd:    headersToAdd(l.HeaderRules.Response),
+		ResponseHeadersToRemove: l.HeaderRules.Response.Remove,
+	}
+}
+
+// helper: turn added and set headers into envoy header options
+func headersToAdd(actions univcfg.HeaderActions) []*core.HeaderValueOption {
+	var options []*core.HeaderValueOption
+	for _, h := range actions.Add {
+		options = append(options, &core.HeaderValueOption{
+			Header:       &core.HeaderValue{Key: h.Name, Value: h.Value},
+			AppendAction: core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+		})
+	}
+	for _, h := range actions.Set {
+		options = append(options, &core.HeaderValueOption{
+			Header:       &core.HeaderValue{Key: h.Name, Value: h.Value},
+			AppendAction: core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	return options
+}
+
+// create locality envoyproxy configuration for endpoints in a region
+func MakeLocality(region string) *core.Locality {
+	if region == "" {
+		return nil
+	}
+	return &core.Locality{
+		Region: region,
 	}
 }
 
@@ -288,41 +714,393 @@ func MakeEndpoint(e *univcfg.Endpoint) *endpoint.LbEndpoint {
 			},
 		},
 	}
-	if e.Weight == 0 {
-		return &endpoint.LbEndpoint{
-			HostIdentifier: hid,
+	// health checks can go to a different port than the one traffic is sent to
+	if e.HealthCheckPort != 0 {
+		hid.Endpoint.HealthCheckConfig = &endpoint.Endpoint_HealthCheckConfig{
+			PortValue: uint32(e.HealthCheckPort),
 		}
-	} else {
-		return &endpoint.LbEndpoint{
-			LoadBalancingWeight: &wpb.UInt32Value{
-				Value: uint32(e.Weight),
+	}
+	lbEndpoint := &endpoint.LbEndpoint{
+		HostIdentifier: hid,
+	}
+	if e.Weight != 0 {
+		lbEndpoint.LoadBalancingWeight = &wpb.UInt32Value{
+			Value: uint32(e.Weight),
+		}
+	}
+	// https endpoints pick up their cluster's tls transport socket
+	if e.Tls {
+		lbEndpoint.Metadata = &core.Metadata{
+			FilterMetadata: map[string]*structpb.Struct{
+				transportSocketMatch: tlsMatch(),
 			},
-			HostIdentifier: hid,
 		}
 	}
+	return lbEndpoint
 }
 
-func transportSocket(cName ...string) *core.TransportSocket {
-	var ctx *anypb.Any
-	if len(cName) == 0 {
-		ctx, _ = anypb.New(&tls.UpstreamTlsContext{})
-	} else {
-		ctx, _ = anypb.New(&tls.DownstreamTlsContext{CommonTlsContext: &tls.CommonTlsContext{
-			TlsCertificates: []*tls.TlsCertificate{{
-				CertificateChain: &core.DataSource{
-					Specifier: &core.DataSource_Filename{
-						Filename: "certs/" + cName[0] + ".crt",
+// header matchers for the route, methods are matched through the ":method" pseudo header
+func headerMatchers(headers []univcfg.HeaderMatch, methods []string) []*route.HeaderMatcher {
+	var matchers []*route.HeaderMatcher
+	for _, h := range headers {
+		m := &route.HeaderMatcher{
+			Name:        h.Name,
+			InvertMatch: h.Invert,
+		}
+		if h.Type == "present" {
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+		} else {
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_StringMatch{StringMatch: stringMatcher(h.Type, h.Value)}
+		}
+		matchers = append(matchers, m)
+	}
+	if len(methods) != 0 {
+		matchers = append(matchers, &route.HeaderMatcher{
+			Name: ":method",
+			HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+				StringMatch: stringMatcher("regex", "^("+strings.Join(methods, "|")+")$"),
+			},
+		})
+	}
+	return matchers
+}
+
+// query parameter matchers for the route
+func queryParamMatchers(params []univcfg.QueryParamMatch) []*route.QueryParameterMatcher {
+	var matchers []*route.QueryParameterMatcher
+	for _, p := range params {
+		m := &route.QueryParameterMatcher{Name: p.Name}
+		if p.Type == "present" {
+			m.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_PresentMatch{PresentMatch: true}
+		} else {
+			m.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_StringMatch{StringMatch: stringMatcher(p.Type, p.Value)}
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers
+}
+
+// string matcher for "exact", "prefix", "suffix", "contains" or "regex" matches
+func stringMatcher(matchType string, value string) *matcher.StringMatcher {
+	switch matchType {
+	case "prefix":
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Prefix{Prefix: value}}
+	case "suffix":
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Suffix{Suffix: value}}
+	case "contains":
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Contains{Contains: value}}
+	case "regex":
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_SafeRegex{
+			SafeRegex: &matcher.RegexMatcher{
+				EngineType: &matcher.RegexMatcher_GoogleRe2{},
+				Regex:      value,
+			},
+		}}
+	default:
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: value}}
+	}
+}
+
+// descriptor actions for the route, tells the global rate limit filter what to key each request on
+// the descriptor is (limit, route, key value), so the service keeps a bucket per route and client
+// and one service config entry per limit covers every route using it, see the readme
+func rateLimitActions(rl *univcfg.RateLimit, routeName string) []*route.RateLimit {
+	actions := []*route.RateLimit_Action{
+		genericKeyAction("limit", strconv.Itoa(int(rl.Count))),
+		genericKeyAction("route", routeName),
+	}
+	switch rl.Field {
+	case "client-ip":
+		actions = append(actions, &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{
+				RemoteAddress: &route.RateLimit_Action_RemoteAddress{},
+			},
+		})
+	case "api-key":
+		// envoy sends no descriptor at all without the header, so requests without a key get their own
+		// descriptor (api_key "none", then the client's address) instead of skipping the limit
+		withoutKey := append(append([]*route.RateLimit_Action(nil), actions...), missingHeaderAction(apiKeyHeader, "api_key", "none"), &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{
+				RemoteAddress: &route.RateLimit_Action_RemoteAddress{},
+			},
+		})
+		actions = append(actions, &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{
+				RequestHeaders: &route.RateLimit_Action_RequestHeaders{
+					HeaderName:    apiKeyHeader,
+					DescriptorKey: "api_key",
+				},
+			},
+		})
+		return []*route.RateLimit{{Actions: actions}, {Actions: withoutKey}}
+	default:
+		return nil
+	}
+	return []*route.RateLimit{{Actions: actions}}
+}
+
+// helper: descriptor entry that's only sent when the request doesn't have the header
+func missingHeaderAction(header string, key string, value string) *route.RateLimit_Action {
+	return &route.RateLimit_Action{
+		ActionSpecifier: &route.RateLimit_Action_HeaderValueMatch_{
+			HeaderValueMatch: &route.RateLimit_Action_HeaderValueMatch{
+				DescriptorKey:   key,
+				DescriptorValue: value,
+				ExpectMatch:     wpb.Bool(false),
+				Headers: []*route.HeaderMatcher{{
+					Name:                 header,
+					HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true},
+				}},
+			},
+		},
+	}
+}
+
+// helper: descriptor entry with a fixed value
+func genericKeyAction(key string, value string) *route.RateLimit_Action {
+	return &route.RateLimit_Action{
+		ActionSpecifier: &route.RateLimit_Action_GenericKey_{
+			GenericKey: &route.RateLimit_Action_GenericKey{
+				DescriptorKey:   key,
+				DescriptorValue: value,
+			},
+		},
+	}
+}
+
+// per route local rate limit config, allows "Count" requests every second shared by every client of the route
+// the local filter can't give each value of a field its own bucket, so those limits go to the rate limit service
+func localRateLimitConfig(rl *univcfg.RateLimit) *anypb.Any {
+	enabled := func(key string) *core.RuntimeFractionalPercent {
+		return &core.RuntimeFractionalPercent{
+			DefaultValue: &typev3.FractionalPercent{
+				Numerator:   100,
+				Denominator: typev3.FractionalPercent_HUNDRED,
+			},
+			RuntimeKey: key,
+		}
+	}
+
+	ctx, _ := anypb.New(&localrl.LocalRateLimit{
+		StatPrefix: localRateLimitStatPrefix,
+		TokenBucket: &typev3.TokenBucket{
+			MaxTokens:     uint32(rl.Count),
+			TokensPerFill: wpb.UInt32(uint32(rl.Count)),
+			FillInterval:  durationpb.New(time.Second),
+		},
+		FilterEnabled:  enabled("local_rate_limit_enabled"),
+		FilterEnforced: enabled("local_rate_limit_enforced"),
+	})
+	return ctx
+}
+
+// global rate limit filter config, requests are let through if the service can't be reached
+func globalRateLimitConfig() *anypb.Any {
+	ctx, _ := anypb.New(&ratelimitfilter.RateLimit{
+		Domain:  rateLimitDomain,
+		Timeout: durationpb.New(100 * time.Millisecond),
+		RateLimitService: &ratelimitcfg.RateLimitServiceConfig{
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: RateLimitCluster},
+				},
+			},
+			TransportApiVersion: resource.DefaultAPIVersion,
+		},
+	})
+	return ctx
+}
+
+// create the cluster of the global rate limit service, it only speaks grpc so it needs http2
+func MakeRateLimitCluster(address string) (*cluster.Cluster, error) {
+	host, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit service address: %+v", err)
+	}
+	port, err := strconv.ParseUint(portValue, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit service port: %s", portValue)
+	}
+
+	options, _ := anypb.New(&upstreamhttp.HttpProtocolOptions{
+		UpstreamProtocolOptions: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+					Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+				},
+			},
+		},
+	})
+	c := &cluster.Cluster{
+		Name:                 RateLimitCluster,
+		ConnectTimeout:       durationpb.New(connectTimeout(0)),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_STRICT_DNS},
+		TypedExtensionProtocolOptions: map[string]*anypb.Any{
+			"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": options,
+		},
+		LoadAssignment: &endpoint.ClusterLoadAssignment{
+			ClusterName: RateLimitCluster,
+			Endpoints: []*endpoint.LocalityLbEndpoints{{
+				LbEndpoints: []*endpoint.LbEndpoint{{
+					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+						Endpoint: &endpoint.Endpoint{
+							Address: &core.Address{
+								Address: &core.Address_SocketAddress{
+									SocketAddress: &core.SocketAddress{
+										Protocol:      core.SocketAddress_TCP,
+										Address:       host,
+										PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(port)},
+									},
+								},
+							},
+						},
+					},
+				}},
+			}},
+		},
+	}
+	return c, nil
+}
+
+// per route rbac config, only lets a request through if one of the groups is in the groups header
+// the header is a semicolon separated list, each group has to match a whole element of it (ignoring case)
+func rbacConfig(groups []string, header string) *anypb.Any {
+	var principals []*rbac.Principal
+	for _, group := range groups {
+		principals = append(principals, &rbac.Principal{
+			Identifier: &rbac.Principal_Header{
+				Header: &route.HeaderMatcher{
+					Name: header,
+					HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+						StringMatch: &matcher.StringMatcher{
+							MatchPattern: &matcher.StringMatcher_SafeRegex{
+								SafeRegex: &matcher.RegexMatcher{
+									EngineType: &matcher.RegexMatcher_GoogleRe2{},
+									Regex:      groupPattern(group),
+								},
+							},
+						},
 					},
 				},
-				PrivateKey: &core.DataSource{
-					Specifier: &core.DataSource_Filename{
-						Filename: "certs/" + cName[0] + ".key",
+			},
+		})
+	}
+
+	ctx, _ := anypb.New(&rbacfilter.RBACPerRoute{
+		Rbac: &rbacfilter.RBAC{
+			Rules: &rbac.RBAC{
+				Action: rbac.RBAC_ALLOW,
+				Policies: map[string]*rbac.Policy{
+					"groups": {
+						Permissions: []*rbac.Permission{{
+							Rule: &rbac.Permission_Any{Any: true},
+						}},
+						Principals: []*rbac.Principal{{
+							Identifier: &rbac.Principal_OrIds{
+								OrIds: &rbac.Principal_Set{Ids: principals},
+							},
+						}},
 					},
 				},
-			}},
-		}})
+			},
+		},
+	})
+	return ctx
+}
+
+// helper: regex matching a groups header list with the group as one of its elements
+// groups are usually distinguished names full of commas, so the list is separated by semicolons
+func groupPattern(group string) string {
+	return `(?i)^(.*;)?\s*` + regexp.QuoteMeta(group) + `\s*(;.*)?$`
+}
+
+// helper: only endpoints marked as https use tls, the rest of the cluster's endpoints stay plaintext
+func transportSocketMatches(t *univcfg.UpstreamTls) []*cluster.Cluster_TransportSocketMatch {
+	return []*cluster.Cluster_TransportSocketMatch{{
+		Name:            "tls",
+		Match:           tlsMatch(),
+		TransportSocket: transportSocket(upstreamTlsContext(t)),
+	}}
+}
+
+// helper: protocol options sending each request's host as the server name, and verifying the certificate against it
+// the routes rewrite the host to the endpoint's hostname, so every endpoint is asked for its own name
+func autoSniOptions(t *univcfg.UpstreamTls) map[string]*anypb.Any {
+	options, _ := anypb.New(&upstreamhttp.HttpProtocolOptions{
+		UpstreamHttpProtocolOptions: &core.UpstreamHttpProtocolOptions{
+			AutoSni:           true,
+			AutoSanValidation: t.CaFile != "" && len(t.SubjectAltNames) == 0,
+		},
+		UpstreamProtocolOptions: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_HttpProtocolOptions{
+					HttpProtocolOptions: &core.Http1ProtocolOptions{},
+				},
+			},
+		},
+	})
+	return map[string]*anypb.Any{
+		"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": options,
 	}
+}
+
+// helper: metadata https endpoints are marked with, and their cluster's tls transport socket matches on
+func tlsMatch() *structpb.Struct {
+	match, _ := structpb.NewStruct(map[string]interface{}{"tls": true})
+	return match
+}
+
+// helper: tls context of a listener, serving the common name's certificate from the certs folder
+func downstreamTlsContext(cName string) *tls.DownstreamTlsContext {
+	return &tls.DownstreamTlsContext{CommonTlsContext: &tls.CommonTlsContext{
+		TlsCertificates: []*tls.TlsCertificate{tlsCertificate("certs/"+cName+".crt", "certs/"+cName+".key")},
+	}}
+}
+
+// helper: tls context of a cluster, endpoints are only verified if there's a ca to check them against
+func upstreamTlsContext(t *univcfg.UpstreamTls) *tls.UpstreamTlsContext {
+	ctx := &tls.UpstreamTlsContext{
+		Sni:              t.Sni,
+		CommonTlsContext: &tls.CommonTlsContext{},
+	}
+	if t.CertFile != "" {
+		ctx.CommonTlsContext.TlsCertificates = []*tls.TlsCertificate{tlsCertificate(t.CertFile, t.KeyFile)}
+	}
+	if t.CaFile != "" {
+		validation := &tls.CertificateValidationContext{
+			TrustedCa: &core.DataSource{
+				Specifier: &core.DataSource_Filename{Filename: t.CaFile},
+			},
+		}
+		for _, san := range t.SubjectAltNames {
+			validation.MatchTypedSubjectAltNames = append(validation.MatchTypedSubjectAltNames, &tls.SubjectAltNameMatcher{
+				SanType: tls.SubjectAltNameMatcher_DNS,
+				Matcher: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{Exact: san},
+				},
+			})
+		}
+		ctx.CommonTlsContext.ValidationContextType = &tls.CommonTlsContext_ValidationContext{
+			ValidationContext: validation,
+		}
+	}
+	return ctx
+}
+
+// helper: certificate and private key read from files on the proxy's host
+func tlsCertificate(certFile string, keyFile string) *tls.TlsCertificate {
+	return &tls.TlsCertificate{
+		CertificateChain: &core.DataSource{
+			Specifier: &core.DataSource_Filename{Filename: certFile},
+		},
+		PrivateKey: &core.DataSource{
+			Specifier: &core.DataSource_Filename{Filename: keyFile},
+		},
+	}
+}
 
+func transportSocket(tlsContext proto.Message) *core.TransportSocket {
+	ctx, _ := anypb.New(tlsContext)
 	return &core.TransportSocket{
 		Name: wellknown.TransportSocketTLS,
 		ConfigType: &core.TransportSocket_TypedConfig{
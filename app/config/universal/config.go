@@ -1,11 +1,42 @@
 package univcfg
 
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
 const (
-	INTERNAL = 0b01
-	EXTERNAL = 0b10
-	BOTH     = 0b11
+	INTERNAL     = 0b001
+	EXTERNAL     = 0b010
+	BOTH         = 0b011
+	GCP_EXTERNAL = 0b100
+	ALL          = 0b111
 )
 
+// zones we have listeners for, in the order their route tables get built
+var Zones = []string{"internal", "external", "gcp-external"}
+
+// availability flag for each zone
+var ZoneMasks = map[string]uint8{
+	"internal":     INTERNAL,
+	"external":     EXTERNAL,
+	"gcp-external": GCP_EXTERNAL,
+}
+
+// two letter extension added to cluster names for every combination of zones
+var suffixes = map[uint8]string{
+	INTERNAL:                "in",
+	EXTERNAL:                "ex",
+	BOTH:                    "ie",
+	GCP_EXTERNAL:            "gc",
+	INTERNAL | GCP_EXTERNAL: "ig",
+	EXTERNAL | GCP_EXTERNAL: "eg",
+	ALL:                     "al",
+}
+
 type Config struct {
 	Listeners map[string]*Listener   // should have one listener for internal, and one for external
 	Clusters  map[string]*Cluster    // one cluster per domain, routes to 1+ endpoints
@@ -14,52 +45,210 @@ type Config struct {
 }
 
 type ListenerInfo struct {
-	InternalAddress    string // address internal listener listens on
-	InternalPort       uint   // port internal listener listens on
-	InternalCommonName string // fully qualified domain name of internal listener
-	ExternalAddress    string // address external listener listens on
-	ExternalPort       uint   // port external listener listens on
-	ExternalCommonName string // fully qualified domain name of external listener
+	InternalAddress    string                 // address internal listener listens on
+	InternalPort       uint                   // port internal listener listens on
+	InternalCommonName string                 // fully qualified domain name of internal listener
+	ExternalAddress    string                 // address external listener listens on
+	ExternalPort       uint                   // port external listener listens on
+	ExternalCommonName string                 // fully qualified domain name of external listener
+	GcpAddress         string                 // address gcp-external listener listens on
+	GcpPort            uint                   // port gcp-external listener listens on (0 disables the listener)
+	GcpCommonName      string                 // fully qualified domain name of gcp-external listener
+	GroupsHeader       string                 // trusted request header listing the groups a caller belongs to
+	GroupsTrustedCidrs []string               // addresses allowed to set the groups header, it's removed from everyone else's requests
+	HeaderRules        map[string]HeaderRules // header changes made on each listener, keyed by listener name
+	RateLimitService   string                 // "host:port" of the global rate limit service, needed for limits keyed on a field
+	RateLimitCounts    []uint                 // counts the rate limit service has rules for, per key limits with any other count are rejected
+	UpstreamTls        UpstreamTls            // ca and client certificate for https backends that don't set their own
 }
 
 type Listener struct {
-	Address    string   // listen on a specific url
-	Name       string   // either "internal" or "external"
-	Port       uint     // should default to 443
-	CommonName string   // fully qualified domain name of listener
-	Routes     []string // maps to cluster from specific path
+	Address            string      // listen on a specific url
+	Name               string      // either "internal", "external" or "gcp-external"
+	Port               uint        // should default to 443
+	CommonName         string      // fully qualified domain name of listener
+	Routes             []string    // maps to cluster from specific path
+	GroupsHeader       string      // trusted request header checked against a route's groups (empty disables check)
+	GroupsTrustedCidrs []string    // addresses allowed to set the groups header
+	HeaderRules        HeaderRules // header changes made on every route of the listener
+	RateLimits         bool        // whether routes can use the global rate limit service
 }
 
 type Cluster struct {
-	Availability uint8        // tells us if the route is internal, external or both
-	Name         string       // should be the path of the url (or config id)
-	Policy       string       // load balancing policy, should default to round robin
-	HealthCheck  *HealthCheck // healthcheck configuration for cluster (optional)
+	Availability     uint8             // tells us if the route is internal, external or both
+	Name             string            // should be the path of the url (or config id)
+	Policy           string            // load balancing policy, should default to round robin ("first" fills endpoints in order)
+	HealthCheck      *HealthCheck      // healthcheck configuration for cluster (optional)
+	ConnectTimeout   time.Duration     // time to wait for a connection to an endpoint, proxy default if 0
+	CircuitBreaker   *CircuitBreaker   // load limits for cluster (optional)
+	OutlierDetection *OutlierDetection // passive health checking for cluster (optional)
+	DnsType          string            // "strict" or "logical", how hostname endpoints get resolved
+	Tls              *UpstreamTls      // set if any of the cluster's endpoints use https
+}
+
+// files are paths on the proxy's host
+type UpstreamTls struct {
+	Sni             string   // server name sent to the endpoints (optional)
+	AutoSni         bool     // send each endpoint's own hostname instead, for endpoints with different hostnames
+	CaFile          string   // bundle the endpoints' certificates are verified against, not verified if empty
+	SubjectAltNames []string // the endpoints' certificates must have one of these (needs a ca)
+	CertFile        string   // client certificate for mtls (optional)
+	KeyFile         string   // private key of the client certificate
+}
+
+// limits of 0 use the proxy's defaults
+type CircuitBreaker struct {
+	MaxConnections     uint // connections open to the cluster
+	MaxPendingRequests uint // requests waiting for a connection
+	MaxRequests        uint // requests in flight
+	MaxRetries         uint // retries in flight
+}
+
+// fields left at 0 use the proxy's defaults
+type OutlierDetection struct {
+	Consecutive5xx     uint          // 5xx responses in a row before an endpoint is ejected
+	EjectionTime       time.Duration // how long an endpoint is ejected for the first time
+	MaxEjectionPercent uint          // most endpoints that can be ejected at once
 }
 
 type Route struct {
-	Availability uint8  // tells us if the route is internal, external or both
-	ClusterName  string // maps upstream from route, could have multiple upstreams
-	Path         string // exact path must be specified
-	Type         string // either "path" or "prefix"
+	Availability  uint8             // tells us if the route is internal, external or both
+	ClusterName   string            // maps upstream from route, could have multiple upstreams
+	Path          string            // exact path must be specified
+	Type          string            // either "path" or "prefix"
+	RateLimit     *RateLimit        // rate limit configuration for route (optional)
+	Groups        []string          // groups allowed to access the route, anyone can access if empty
+	Headers       []HeaderMatch     // request headers that must match, on top of the path
+	Methods       []string          // http methods the route matches, matches any method if empty
+	QueryParams   []QueryParamMatch // query parameters that must match, on top of the path
+	PrefixRewrite string            // replaces the matched path prefix before forwarding upstream (optional)
+	RegexRewrite  *RegexRewrite     // rewrites the path with a regex before forwarding upstream (optional)
+	Timeout       time.Duration     // time to wait for the whole response, proxy default if 0
+	IdleTimeout   time.Duration     // time a request can go without activity, proxy default if 0
+	Retry         *RetryPolicy      // retry configuration for route (optional)
+	Splits        []WeightedCluster // clusters sharing the route's traffic by weight, only ClusterName gets it if empty
+	HeaderRules   HeaderRules       // header changes made on the route's requests and responses
+	Cors          *CorsPolicy       // cors configuration for route (optional)
+	HashPolicy    *HashPolicy       // what requests are hashed on, for clusters with a hash based policy (optional)
+	Direct        *DirectResponse   // answer requests without going upstream (optional)
+	Redirect      *Redirect         // redirect requests instead of going upstream (optional)
+}
+
+type DirectResponse struct {
+	Status uint   // http status code of the response
+	Body   string // body of the response
+}
+
+type Redirect struct {
+	Scheme string // scheme to redirect to, kept if empty
+	Host   string // host to redirect to, kept if empty
+	Port   uint   // port to redirect to, kept if 0
+	Path   string // replaces the whole path (optional)
+	Prefix string // replaces the matched prefix (optional)
+	Status uint   // http status code of the redirect
+}
+
+type HashPolicy struct {
+	Type string // "source_ip", "path", "header", "query_param" or "cookie"
+	Name string // name of the header, query parameter or cookie
+}
+
+type CorsPolicy struct {
+	AllowCredentials bool          // browsers can send cookies and auth headers
+	AllowHeaders     []string      // request headers browsers can send
+	AllowMethods     []string      // http methods browsers can use
+	AllowOrigins     []CorsOrigin  // sites allowed to call the route
+	ExposeHeaders    []string      // response headers browsers can read
+	MaxAge           time.Duration // how long browsers can cache a preflight, browser default if 0
+}
+
+type CorsOrigin struct {
+	Type  string // either "exact" or "regex"
+	Value string // origin or regex matching origins
+}
+
+type HeaderRules struct {
+	Request  HeaderActions // changes made to requests before they're sent upstream
+	Response HeaderActions // changes made to responses before they're sent back
+}
+
+type HeaderActions struct {
+	Add    []HeaderValue // added on top of any existing values
+	Set    []HeaderValue // replace any existing values
+	Remove []string      // names of headers to remove
+}
+
+type HeaderValue struct {
+	Name  string // name of the header
+	Value string // value of the header
+}
+
+type WeightedCluster struct {
+	Name   string // name of the cluster
+	Weight uint   // percentage of the route's traffic the cluster gets
+}
+
+type RetryPolicy struct {
+	Count         uint          // number of retries
+	On            []string      // conditions a request gets retried on
+	PerTryTimeout time.Duration // time to wait for each try, proxy default if 0
+}
+
+type RegexRewrite struct {
+	Pattern      string // re2 regex matched against the path
+	Substitution string // replacement for the matched parts, can use capture groups
+}
+
+type HeaderMatch struct {
+	Invert bool   // match when the header doesn't match
+	Name   string // name of the header
+	Type   string // "exact", "prefix", "suffix", "contains", "regex" or "present"
+	Value  string // value the header gets matched against
+}
+
+type QueryParamMatch struct {
+	Name  string // name of the query parameter
+	Type  string // "exact", "prefix", "suffix", "contains", "regex" or "present"
+	Value string // value the query parameter gets matched against
 }
 
 type Endpoint struct {
-	Address     string // where the user actually gets sent
-	ClusterName string // name of cluster that owns the endpoint
-	Port        uint   // default to 443
-	Region      string // "global", "ttc", or "ttce"
-	Weight      uint   // should default to 0 unless "Balance" set to weighted round robin
+	Address         string // where the user actually gets sent
+	ClusterName     string // name of cluster that owns the endpoint
+	HealthCheckPort uint   // port health checks get sent to, 0 if it's the same as Port
+	Port            uint   // default to 443
+	Region          string // "global", "ttc", or "ttce"
+	Tls             bool   // set if the endpoint is called over https, using its cluster's tls settings
+	Weight          uint   // should default to 0 unless "Balance" set to weighted round robin
 }
 
 type HealthCheck struct {
-	Healthy   uint   // number of healthy checks required befor host marked healthy
-	Host      string // value of host header in HTTP health check request
-	Interval  uint   // number of seconds healthcheck interval lasts
-	Path      string // specifies HTTP path used for health check request
-	Port      uint   // port of host getting healtchecked (don't think envoy can do anything with this)
-	Type      string // you can use either HTTP or TCP (default TCP)
-	Unhealthy uint   // number of unhealthy checks required befor host marked unhealthy
+	ExpectedStatuses []StatusRange // ranges of HTTP status codes considered healthy
+	Healthy          uint          // number of healthy checks required befor host marked healthy
+	Host             string        // value of host header in HTTP health check request
+	Interval         time.Duration // time between health checks
+	Method           string        // HTTP method used for health check request
+	Path             string        // specifies HTTP path used for health check request
+	Port             uint          // port of host getting healtchecked, applied to each endpoint of the cluster
+	Timeout          time.Duration // time to wait for a health check response
+	Type             string        // you can use either HTTP or TCP (default TCP)
+	Unhealthy        uint          // number of unhealthy checks required befor host marked unhealthy
+	Version          string        // HTTP version of health check request, either "HTTP/1.1" or "HTTP/2"
+}
+
+type StatusRange struct {
+	Start uint // first status code in range
+	End   uint // last status code in range (inclusive)
+}
+
+type RateLimit struct {
+	Count uint   // number of requests allowed per second
+	Field string // what the limit is keyed on, either "client-ip", "api-key", or empty for the whole route
+}
+
+// limits keyed on a field need a bucket per value, which only the global rate limit service has
+func (rl *RateLimit) PerKey() bool {
+	return rl.Field != ""
 }
 
 // initialize map fields in our object
@@ -73,28 +262,22 @@ func NewConfig() *Config {
 }
 
 // add a listener to our configuration object
-func (cfg *Config) AddListener(address string, name string, port uint, cName string) {
+func (cfg *Config) AddListener(address string, name string, port uint, cName string) *Listener {
 	cfg.Listeners[name] = &Listener{
 		Address:    address,
 		Name:       name,
 		Port:       port,
 		CommonName: cName,
 	}
+	return cfg.Listeners[name]
 }
 
 // add a cluster to our configuration object
 // also set availability flag based on cluster name
-func (cfg *Config) AddCluster(name string, policy string, healthcheck *HealthCheck) {
-	var availability uint8
-	switch name[len(name)-2:] {
-	case "in":
-		availability = INTERNAL
-	case "ex":
-		availability = EXTERNAL
-	case "ie":
-		availability = BOTH
-	default:
-		panic("invalid availability")
+func (cfg *Config) AddCluster(name string, policy string, healthcheck *HealthCheck) (*Cluster, error) {
+	availability := Availability(name)
+	if availability == 0 {
+		return nil, fmt.Errorf("invalid availability in cluster name: %s", name)
 	}
 	cfg.Clusters[name] = &Cluster{
 		Availability: availability,
@@ -102,63 +285,264 @@ func (cfg *Config) AddCluster(name string, policy string, healthcheck *HealthChe
 		Policy:       policy,
 		HealthCheck:  healthcheck,
 	}
+	return cfg.Clusters[name], nil
 }
 
 // add a route to our configuration object
 // also set availability flag based on cluster name
-func (cfg *Config) AddRoute(clusterName string, path string, pathType string) {
-	var availability uint8
-	switch clusterName[len(clusterName)-2:] {
-	case "in":
-		availability = INTERNAL
-	case "ex":
-		availability = EXTERNAL
-	case "ie":
-		availability = BOTH
-	default:
-		panic("invalid availability")
+func (cfg *Config) AddRoute(clusterName string, path string, pathType string, rateLimit *RateLimit) (*Route, error) {
+	availability := Availability(clusterName)
+	if availability == 0 {
+		return nil, fmt.Errorf("invalid availability in cluster name: %s", clusterName)
 	}
 	cfg.Routes[clusterName] = &Route{
 		Availability: availability,
 		ClusterName:  clusterName,
 		Path:         path,
 		Type:         pathType,
+		RateLimit:    rateLimit,
 	}
+	return cfg.Routes[clusterName], nil
 }
 
 // add an endpoint to our configuration object
-func (cfg *Config) AddEndpoint(address string, clusterName string, port uint, region string, weight uint) {
-	cfg.Endpoints[clusterName] = append(cfg.Endpoints[clusterName], &Endpoint{
+func (cfg *Config) AddEndpoint(address string, clusterName string, port uint, region string, weight uint) *Endpoint {
+	e := &Endpoint{
 		Address:     address,
 		ClusterName: clusterName,
 		Port:        port,
 		Region:      region,
 		Weight:      weight,
+	}
+	cfg.Endpoints[clusterName] = append(cfg.Endpoints[clusterName], e)
+	return e
+}
+
+// get the cluster name extension for a set of zones, empty if there's no zone
+func Suffix(availability uint8) string {
+	return suffixes[availability]
+}
+
+// check if every endpoint is an ip address, so the proxy doesn't have to resolve anything
+func IPEndpoints(edps []*Endpoint) bool {
+	if len(edps) == 0 {
+		return false
+	}
+	for _, e := range edps {
+		if net.ParseIP(e.Address) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// name of the cluster for one of a backend's splits, keeps the backend cluster's extension
+func SplitName(clusterName string, split string) string {
+	if len(clusterName) <= 2 {
+		return split + "-" + clusterName
+	}
+	return clusterName[:len(clusterName)-3] + "+" + split + clusterName[len(clusterName)-3:]
+}
+
+// get the set of zones from a cluster name's extension, 0 if the extension isn't valid
+func Availability(name string) uint8 {
+	if len(name) < 2 {
+		return 0
+	}
+	for availability, suffix := range suffixes {
+		if name[len(name)-2:] == suffix {
+			return availability
+		}
+	}
+	return 0
+}
+
+// a cluster or route name, or a route match on a listener, claimed by two configs
+type Conflict struct {
+	Kind  string // "cluster", "route" or "path"
+	Name  string // name both configs use, or the path, path type, listener and match conditions of the route
+	Older string // key of the config that claimed the name first
+	Newer string // key of the config that claimed it after
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s %s is claimed by both %s and %s", c.Kind, c.Name, c.Older, c.Newer)
+}
+
+// find configs claiming cluster or route names, or route matches, another config already has, keys are given oldest first
+// two routes with different names can still match the same requests on a listener, and envoy would only ever use one of them
+// the newer config of a conflict is always rejected, rejectBoth rejects the older one too
+// returns the configs that are left plus the first conflict found between each pair of configs
+func ResolveConflicts(configs map[string]*Config, keys []string, rejectBoth bool) (map[string]*Config, []Conflict) {
+	var conflicts []Conflict
+	rejected := make(map[string]bool)
+	owners := make(map[claim]string)
+
+	for _, key := range keys {
+		claims := claimsOf(configs[key])
+		reported := make(map[string]bool)
+		for _, c := range claims {
+			owner, ok := owners[c]
+			if !ok {
+				continue
+			}
+			if !reported[owner] {
+				conflicts = append(conflicts, Conflict{Kind: c.kind, Name: c.name, Older: owner, Newer: key})
+				reported[owner] = true
+			}
+			rejected[key] = true
+			if rejectBoth {
+				rejected[owner] = true
+			}
+		}
+		// a rejected config doesn't get to keep names nobody else had claimed yet
+		if !rejected[key] {
+			for _, c := range claims {
+				owners[c] = key
+			}
+		}
+	}
+
+	accepted := make(map[string]*Config)
+	for _, key := range keys {
+		if !rejected[key] {
+			accepted[key] = configs[key]
+		}
+	}
+	return accepted, conflicts
+}
+
+// something only one config can have, a route name shares its kind with the cluster of the same name
+type claim struct {
+	kind string
+	name string
+}
+
+// helper: names and route matches a config claims, names come first (sorted), then route matches (sorted)
+// a route named after one of the config's clusters is only claimed once
+func claimsOf(config *Config) []claim {
+	kinds := make(map[string]string)
+	for name := range config.Routes {
+		kinds[name] = "route"
+	}
+	for name := range config.Clusters {
+		kinds[name] = "cluster"
+	}
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var matches []string
+	for zone, l := range config.Listeners {
+		for _, name := range l.Routes {
+			if r, ok := config.Routes[name]; ok {
+				matches = append(matches, routeMatch(zone, r))
+			}
+		}
+	}
+	sort.Strings(matches)
+
+	claims := make([]claim, 0, len(names)+len(matches))
+	for _, name := range names {
+		claims = append(claims, claim{kind: kinds[name], name: name})
+	}
+	for _, match := range matches {
+		claims = append(claims, claim{kind: "path", name: match})
+	}
+	return claims
+}
+
+// helper: describe which requests a route matches on a listener, routes matching the same requests get the same description
+func routeMatch(zone string, r *Route) string {
+	var conditions []string
+	methods := append([]string(nil), r.Methods...)
+	sort.Strings(methods)
+	if len(methods) != 0 {
+		conditions = append(conditions, "methods "+strings.Join(methods, " "))
+	}
+	for _, h := range r.Headers {
+		condition := fmt.Sprintf("header %s %s %q", h.Name, h.Type, h.Value)
+		if h.Invert {
+			condition = "not " + condition
+		}
+		conditions = append(conditions, condition)
+	}
+	for _, q := range r.QueryParams {
+		conditions = append(conditions, fmt.Sprintf("query %s %s %q", q.Name, q.Type, q.Value))
+	}
+	// the order conditions are listed in doesn't change what they match
+	sort.Strings(conditions)
+	conditions = append([]string{r.Type, "on " + zone}, conditions...)
+	return fmt.Sprintf("%s (%s)", r.Path, strings.Join(conditions, ", "))
+}
+
+// order envoy tries path types in, it uses the first route that matches
+var pathTypeOrder = map[string]int{
+	"exact":       0,
+	"regex":       1,
+	"starts_with": 2,
+}
+
+// sort route names into the order envoy should try them in
+// exact paths come before regexes, which come before prefixes, and longer prefixes come before shorter ones
+// routes on the same path that match on headers, query parameters or methods go before the plain route
+// anything left is ordered by path and then name, so the order never depends on map iteration
+func SortRoutes(names []string, routes map[string]*Route) {
+	sort.SliceStable(names, func(i, j int) bool {
+		a, b := routes[names[i]], routes[names[j]]
+		if pathTypeOrder[a.Type] != pathTypeOrder[b.Type] {
+			return pathTypeOrder[a.Type] < pathTypeOrder[b.Type]
+		}
+		if a.Type == "starts_with" && len(a.Path) != len(b.Path) {
+			return len(a.Path) > len(b.Path)
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.HasConditions() != b.HasConditions() {
+			return a.HasConditions()
+		}
+		return names[i] < names[j]
 	})
 }
 
+// check if a route matches on headers, query parameters or methods on top of its path
+func (r *Route) HasConditions() bool {
+	return len(r.Headers) != 0 || len(r.QueryParams) != 0 || len(r.Methods) != 0
+}
+
+// merge configs in key order, so lists built from them come out the same every time
 func MergeConfigs(configs map[string]*Config) *Config {
 	bigConfig := NewConfig()
 
-	for _, config := range configs {
+	keys := make([]string, 0, len(configs))
+	for key := range configs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		config := configs[key]
 		for _, l := range config.Listeners {
 			if bigConfig.Listeners[l.Name] == nil {
-				bigConfig.AddListener(l.Address, l.Name, l.Port, l.CommonName)
+				listener := *l
+				listener.Routes = nil
+				bigConfig.Listeners[l.Name] = &listener
 			}
 			for _, r := range l.Routes {
 				bigConfig.Listeners[l.Name].Routes = append(bigConfig.Listeners[l.Name].Routes, r)
 			}
 		}
 		for _, c := range config.Clusters {
-			bigConfig.AddCluster(c.Name, c.Policy, c.HealthCheck)
+			bigConfig.Clusters[c.Name] = c
 		}
 		for _, r := range config.Routes {
-			bigConfig.AddRoute(r.ClusterName, r.Path, r.Type)
+			bigConfig.Routes[r.ClusterName] = r
 		}
-		for _, edps := range config.Endpoints {
-			for _, e := range edps {
-				bigConfig.AddEndpoint(e.Address, e.ClusterName, e.Port, e.Region, e.Weight)
-			}
+		for name, edps := range config.Endpoints {
+			bigConfig.Endpoints[name] = append(bigConfig.Endpoints[name], edps...)
 		}
 	}
 
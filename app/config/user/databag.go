@@ -1,70 +1,212 @@
 package usercfg
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	toml "github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v3"
 )
 
 type Bag struct {
-	Availability []string  `json:"availability"` // "internal", "external", or both
-	Backends     []Backend `json:"backends"`     // "match" maps to route, "availability" maps to listener, the rest go to cluster
-	Groups       []string  `json:"groups"`       // not my problem for now
-	Id           string    `json:"id"`           // url path swapped with dashes
+	Availability []string  `json:"availability" yaml:"availability" toml:"availability"` // any of "internal", "external" and "gcp-external", defaults to internal + external
+	Backends     []Backend `json:"backends" yaml:"backends" toml:"backends"`             // "match" maps to route, "availability" maps to listener, the rest go to cluster
+	Cors         Cors      `json:"cors" yaml:"cors" toml:"cors"`                         // lets browsers on other sites call the api, off if no origins are allowed
+	Groups       []string  `json:"groups" yaml:"groups" toml:"groups"`                   // groups allowed to call the api, anyone can if empty
+	Headers      Headers   `json:"headers" yaml:"headers" toml:"headers"`                // headers changed on every backend's requests and responses
+	Id           string    `json:"id" yaml:"id" toml:"id"`                               // url path swapped with dashes
 }
 
 type Backend struct {
-	Availability  []string    `json:"availability"`         // "internal", "external", or both.  DEFAULT TO BOTH
-	Balance       string      `json:"balance"`              // load balancing policy, default should be round robin
-	HealthCheck   HealthCheck `json:"healthcheck"`          // don't worry about this for now
-	IgnoreDefault bool        `json:"ignore_default_match"` // set to true if ignoring default match pattern
-	Match         Match       `json:"match"`                // if match set, then listener should check route paths until finding a match
-	RateLimit     RateLimit   `json:"rate_limit"`           // don't worry about this one either
-	Server        Server      `json:"servers"`              // basically a cluster
+	Availability  []string    `json:"availability" yaml:"availability" toml:"availability"`                         // any of the bag's zones.  DEFAULT TO ALL OF THEM
+	Balance       string      `json:"balance" yaml:"balance" toml:"balance"`                                        // haproxy balance algorithm (e.g. "leastconn", "source", "hdr(x-user-id)"), defaults to round robin
+	Breaker       Breaker     `json:"circuit_breaker" yaml:"circuit_breaker" toml:"circuit_breaker"`                // limits on how much load the backend's servers are put under
+	Cors          Cors        `json:"cors" yaml:"cors" toml:"cors"`                                                 // replaces the bag's cors policy if any origins are allowed
+	Direct        Direct      `json:"direct_response" yaml:"direct_response" toml:"direct_response"`                // answer requests without calling any servers
+	Dns           string      `json:"dns" yaml:"dns" toml:"dns"`                                                    // how hostname endpoints are resolved, "strict" (default) or "logical" (single endpoint only)
+	Headers       Headers     `json:"headers" yaml:"headers" toml:"headers"`                                        // headers changed on the backend's requests and responses, on top of the bag's
+	HealthCheck   HealthCheck `json:"healthcheck" yaml:"healthcheck" toml:"healthcheck"`                            // active health checking of the backend's endpoints
+	IgnoreDefault bool        `json:"ignore_default_match" yaml:"ignore_default_match" toml:"ignore_default_match"` // set to true if ignoring default match pattern
+	Maintenance   bool        `json:"maintenance" yaml:"maintenance" toml:"maintenance"`                            // set to true to answer every request with a 503 and the maintenance message
+	Message       string      `json:"maintenance_message" yaml:"maintenance_message" toml:"maintenance_message"`    // body of maintenance responses, defaults to saying the api is down
+	Match         Match       `json:"match" yaml:"match" toml:"match"`                                              // if match set, then listener should check route paths until finding a match
+	Outlier       Outlier     `json:"outlier_detection" yaml:"outlier_detection" toml:"outlier_detection"`          // stop sending traffic to endpoints that keep failing
+	RateLimit     RateLimit   `json:"rate_limit" yaml:"rate_limit" toml:"rate_limit"`                               // limits number of requests per second for the backend
+	Redirect      Redirect    `json:"redirect" yaml:"redirect" toml:"redirect"`                                     // send clients somewhere else instead of calling any servers
+	Retry         Retry       `json:"retry" yaml:"retry" toml:"retry"`                                              // when and how often failed requests are retried
+	Rewrite       Rewrite     `json:"rewrite" yaml:"rewrite" toml:"rewrite"`                                        // how the path gets changed before it's sent upstream
+	Server        Server      `json:"servers" yaml:"servers" toml:"servers"`                                        // basically a cluster
+	Splits        []Split     `json:"splits" yaml:"splits" toml:"splits"`                                           // extra server groups that get a percentage of the backend's traffic
+	Timeouts      Timeouts    `json:"timeouts" yaml:"timeouts" toml:"timeouts"`                                     // how long to wait on the backend, envoy's defaults if empty
+	Tls           Tls         `json:"tls" yaml:"tls" toml:"tls"`                                                    // how https endpoints are verified and connected to
 }
 
 type Server struct {
-	Endpoints []Endpoint // server is essentially a cluster with 1+ endpoints
+	Endpoints []Endpoint `json:"endpoints" yaml:"endpoints" toml:"endpoints"` // server is essentially a cluster with 1+ endpoints
+}
+
+// a server group taking a share of a backend's traffic (e.g. a canary)
+// "servers" gets whatever percentage the splits leave over
+type Split struct {
+	Name   string `json:"name" yaml:"name" toml:"name"`          // name of the group, unique within the backend
+	Server Server `json:"servers" yaml:"servers" toml:"servers"` // endpoints of the group
+	Weight uint   `json:"weight" yaml:"weight" toml:"weight"`    // percentage of traffic sent to the group
+}
+
+type Direct struct {
+	Body   string `json:"body" yaml:"body" toml:"body"`       // body of the response
+	Status uint   `json:"status" yaml:"status" toml:"status"` // http status code of the response
+}
+
+// anything left empty is kept from the original request
+type Redirect struct {
+	Host   string `json:"host" yaml:"host" toml:"host"`       // host (and optionally port) to redirect to
+	Path   string `json:"path" yaml:"path" toml:"path"`       // replaces the whole path
+	Prefix string `json:"prefix" yaml:"prefix" toml:"prefix"` // replaces the matched path prefix, keeping the rest of the path
+	Scheme string `json:"scheme" yaml:"scheme" toml:"scheme"` // either "http" or "https"
+	Status uint   `json:"status" yaml:"status" toml:"status"` // 301, 302, 303, 307 or 308, defaults to 301
 }
 
 type Endpoint struct {
-	Address string `json:"address"` // where the user actually gets sent
-	Port    uint   `json:"port"`    // default to 443
-	Region  string `json:"region"`  // "global", "ttc", or "ttce"
-	Weight  uint   `json:"weight"`  // should default to 0 unless "Balance" set to weighted round robin
+	Address string `json:"address" yaml:"address" toml:"address"` // where the user actually gets sent, a url path is used as the upstream base path
+	Port    uint   `json:"port" yaml:"port" toml:"port"`          // default to 443
+	Region  string `json:"region" yaml:"region" toml:"region"`    // "global", "ttc", or "ttce"
+	Weight  uint   `json:"weight" yaml:"weight" toml:"weight"`    // should default to 0 unless "Balance" set to weighted round robin
+}
+
+// limits left at 0 use envoy's defaults
+type Breaker struct {
+	MaxConnections     uint `json:"max_connections" yaml:"max_connections" toml:"max_connections"`                // connections open to all of the backend's endpoints
+	MaxPendingRequests uint `json:"max_pending_requests" yaml:"max_pending_requests" toml:"max_pending_requests"` // requests waiting for a connection
+	MaxRequests        uint `json:"max_requests" yaml:"max_requests" toml:"max_requests"`                         // requests in flight
+	MaxRetries         uint `json:"max_retries" yaml:"max_retries" toml:"max_retries"`                            // retries in flight
+}
+
+// passive health checking, an endpoint is ejected once it returns too many 5xx responses in a row
+// turned on by setting any of the fields, the ones left empty use envoy's defaults
+type Outlier struct {
+	Consecutive5xx     uint   `json:"consecutive_5xx" yaml:"consecutive_5xx" toml:"consecutive_5xx"`                // 5xx responses in a row before an endpoint is ejected, defaults to 5
+	EjectionTime       string `json:"ejection_time" yaml:"ejection_time" toml:"ejection_time"`                      // how long an endpoint is ejected for the first time, same format as timeouts, defaults to 30s
+	MaxEjectionPercent uint   `json:"max_ejection_percent" yaml:"max_ejection_percent" toml:"max_ejection_percent"` // most endpoints that can be ejected at once, defaults to 10
 }
 
-// i don't really know what the healthcheck does (for now)
+type Cors struct {
+	AllowCredentials bool         `json:"allow_credentials" yaml:"allow_credentials" toml:"allow_credentials"` // set to true to let browsers send cookies and auth headers
+	AllowHeaders     []string     `json:"allow_headers" yaml:"allow_headers" toml:"allow_headers"`             // request headers browsers can send
+	AllowMethods     []string     `json:"allow_methods" yaml:"allow_methods" toml:"allow_methods"`             // http methods browsers can use
+	AllowOrigins     []CorsOrigin `json:"allow_origins" yaml:"allow_origins" toml:"allow_origins"`             // sites allowed to call the api
+	ExposeHeaders    []string     `json:"expose_headers" yaml:"expose_headers" toml:"expose_headers"`          // response headers browsers can read
+	MaxAge           string       `json:"max_age" yaml:"max_age" toml:"max_age"`                               // how long browsers can cache a preflight, same format as timeouts
+}
+
+type CorsOrigin struct {
+	Type  string `json:"type" yaml:"type" toml:"type"`    // either "exact" or "regex", defaults to exact
+	Value string `json:"value" yaml:"value" toml:"value"` // origin (e.g. "https://www.target.com") or a regex matching origins
+}
+
+type Headers struct {
+	Request  HeaderActions `json:"request" yaml:"request" toml:"request"`    // changes made to requests before they're sent upstream
+	Response HeaderActions `json:"response" yaml:"response" toml:"response"` // changes made to responses before they're sent back
+}
+
+type HeaderActions struct {
+	Add    map[string]string `json:"add" yaml:"add" toml:"add"`          // header name -> value, added on top of any existing values
+	Remove []string          `json:"remove" yaml:"remove" toml:"remove"` // names of headers to remove
+	Set    map[string]string `json:"set" yaml:"set" toml:"set"`          // header name -> value, replacing any existing values
+}
+
+// mirrors haproxy's health check options
 type HealthCheck struct {
-	Fall     uint   `json:"fall"`
-	Host     string `json:"host"`
-	Interval string `json:"interval"`
-	Method   string `json:"method"`
-	Path     string `json:"path"`
-	Port     uint   `json:"port"`
-	Rise     uint   `json:"rise"`
-	Type     string `json:"type"`
-	Version  string `json:"version"`
+	ExpectedStatus []string `json:"expected_status" yaml:"expected_status" toml:"expected_status"` // healthy status codes or ranges (e.g. "200" or "200-399")
+	Fall           uint     `json:"fall" yaml:"fall" toml:"fall"`                                  // failed checks before host is marked unhealthy
+	Host           string   `json:"host" yaml:"host" toml:"host"`                                  // host header sent with http checks
+	Interval       string   `json:"interval" yaml:"interval" toml:"interval"`                      // time between checks, haproxy format (e.g. "500ms", "2m", bare numbers are ms)
+	Method         string   `json:"method" yaml:"method" toml:"method"`                            // http method of the check, defaults to GET
+	Path           string   `json:"path" yaml:"path" toml:"path"`                                  // http path of the check
+	Port           uint     `json:"port" yaml:"port" toml:"port"`                                  // port checks are sent to, if not the endpoint's port
+	Rise           uint     `json:"rise" yaml:"rise" toml:"rise"`                                  // passed checks before host is marked healthy
+	Timeout        string   `json:"timeout" yaml:"timeout" toml:"timeout"`                         // time to wait for a response, same format as interval
+	Type           string   `json:"type" yaml:"type" toml:"type"`                                  // either "http" or "tcp"
+	Version        string   `json:"version" yaml:"version" toml:"version"`                         // either "HTTP/1.1" or "HTTP/2"
 }
 
 type Match struct {
-	Path Path `json:"path"` // info on how to match the url
+	Headers     []HeaderMatch     `json:"headers" yaml:"headers" toml:"headers"`                // request headers that must match, all of them have to
+	Methods     []string          `json:"methods" yaml:"methods" toml:"methods"`                // http methods that match, any of them can
+	Path        Path              `json:"path" yaml:"path" toml:"path"`                         // info on how to match the url
+	QueryParams []QueryParamMatch `json:"query_params" yaml:"query_params" toml:"query_params"` // query parameters that must match, all of them have to
+}
+
+type HeaderMatch struct {
+	Invert bool   `json:"invert" yaml:"invert" toml:"invert"` // set to true to match requests where the header doesn't match
+	Name   string `json:"name" yaml:"name" toml:"name"`       // name of the header
+	Type   string `json:"type" yaml:"type" toml:"type"`       // "exact", "prefix", "suffix", "contains", "regex" or "present", defaults to exact
+	Value  string `json:"value" yaml:"value" toml:"value"`    // value the header is matched against
+}
+
+type QueryParamMatch struct {
+	Name  string `json:"name" yaml:"name" toml:"name"`    // name of the query parameter
+	Type  string `json:"type" yaml:"type" toml:"type"`    // "exact", "prefix", "suffix", "contains", "regex" or "present", defaults to exact
+	Value string `json:"value" yaml:"value" toml:"value"` // value the query parameter is matched against
 }
 
 type Path struct {
-	Pattern string `json:"pattern"` // url path, also cluster name
-	Type    string `json:"type"`    // either "exact" or "starts_with"
+	Pattern string `json:"pattern" yaml:"pattern" toml:"pattern"` // url path, also cluster name
+	Type    string `json:"type" yaml:"type" toml:"type"`          // either "exact" or "starts_with"
+}
+
+// durations use the same format as health check intervals
+type Timeouts struct {
+	Connect string `json:"connect" yaml:"connect" toml:"connect"` // time to wait for a connection to an endpoint, defaults to 5s
+	Idle    string `json:"idle" yaml:"idle" toml:"idle"`          // time a request can go without any activity
+	Request string `json:"request" yaml:"request" toml:"request"` // time to wait for the whole response, defaults to 15s
+}
+
+// only used for endpoints with an https scheme (or port 443 if they have no scheme)
+// ca, cert and key are paths on the proxy's host, the daemon's defaults are used if they're empty
+type Tls struct {
+	Ca        string   `json:"ca" yaml:"ca" toml:"ca"`                         // bundle the endpoints' certificates are verified against
+	Cert      string   `json:"cert" yaml:"cert" toml:"cert"`                   // client certificate for endpoints that require mtls
+	Insecure  bool     `json:"insecure" yaml:"insecure" toml:"insecure"`       // don't verify the endpoints' certificates at all
+	Key       string   `json:"key" yaml:"key" toml:"key"`                      // private key of the client certificate
+	Sni       string   `json:"sni" yaml:"sni" toml:"sni"`                      // server name sent to the endpoints, defaults to their hostname
+	VerifySan []string `json:"verify_san" yaml:"verify_san" toml:"verify_san"` // the endpoints' certificates must have one of these subject alt names
+}
+
+type Retry struct {
+	Count         uint     `json:"count" yaml:"count" toml:"count"`                               // number of retries, retrying is off if 0
+	On            []string `json:"on" yaml:"on" toml:"on"`                                        // envoy retry conditions (e.g. "5xx", "reset"), defaults to connection failures
+	PerTryTimeout string   `json:"per_try_timeout" yaml:"per_try_timeout" toml:"per_try_timeout"` // time to wait for each try, same format as timeouts
+}
+
+// only one of prefix and regex can be set
+type Rewrite struct {
+	Prefix string       `json:"prefix" yaml:"prefix" toml:"prefix"` // replaces the matched path prefix (e.g. "/" strips it)
+	Regex  RegexRewrite `json:"regex" yaml:"regex" toml:"regex"`    // rewrites the parts of the path matching a pattern
+}
+
+type RegexRewrite struct {
+	Pattern      string `json:"pattern" yaml:"pattern" toml:"pattern"`                // re2 regex matched against the path
+	Substitution string `json:"substitution" yaml:"substitution" toml:"substitution"` // replacement, can use capture groups (e.g. "\\1")
 }
 
 type RateLimit struct {
-	Count uint   `json:"count"` // number of times link accessed per second
-	Field string `json:"field"` // don't needa worry bout rate limit right now
+	Count uint   `json:"count" yaml:"count" toml:"count"` // number of times link accessed per second
+	Field string `json:"field" yaml:"field" toml:"field"` // either "client-ip", "api-key", or empty to limit the route as a whole
 }
 
-// turn json file into a resource object
+// turn databag file into resource objects, the file extension decides how it's decoded
+// every bag is validated against the databag schema first
+// json files can hold a single bag, a json array of bags, or newline delimited bags
+// yaml files can hold a single bag, a list of bags, or several "---" separated documents
+// toml files can hold a single bag, or an array of bags under "bags"
 func ParseFile(filename string) ([]Bag, error) {
 	var bags []Bag
-	var bag Bag
 
 	// get directory contents
 	file, err := ioutil.ReadFile(filename)
@@ -72,12 +214,156 @@ func ParseFile(filename string) ([]Bag, error) {
 		return nil, fmt.Errorf("ERROR - couldn't read file: %s\n", err)
 	}
 
-	// parse each file into a data bag
-	err = json.Unmarshal(file, &bag)
-	if err != nil {
+	format := fileFormat(filename)
+
+	// catch typos and bad values before they make it anywhere near the proxy
+	if err = validateFile(filename, file, format); err != nil {
 		return nil, err
 	}
-	bags = append(bags, bag)
+
+	switch format {
+	case "yaml":
+		bags, err = parseYAML(file)
+	case "toml":
+		bags, err = parseTOML(file)
+	default:
+		bags, err = parseJSON(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %+v", filename, err)
+	}
 
 	return bags, nil
 }
+
+// helper: the file extension decides how a file is decoded, json if it's anything else
+func fileFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+func parseJSON(file []byte) ([]Bag, error) {
+	var bags []Bag
+
+	// a json array holds every bag in the file
+	if trimmed := bytes.TrimSpace(file); len(trimmed) > 0 && trimmed[0] == '[' {
+		decoder := json.NewDecoder(bytes.NewReader(file))
+		if err := decoder.Decode(&bags); err != nil {
+			return nil, jsonError(file, decoder, err)
+		}
+		return bags, nil
+	}
+
+	// otherwise decode one bag after another until we run out of file
+	decoder := json.NewDecoder(bytes.NewReader(file))
+	for {
+		var bag Bag
+		err := decoder.Decode(&bag)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bag %d: %+v", len(bags), jsonError(file, decoder, err))
+		}
+		bags = append(bags, bag)
+	}
+
+	return bags, nil
+}
+
+// helper: json errors only know the byte offset, so turn it into a line number
+func jsonError(file []byte, decoder *json.Decoder, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		offset = decoder.InputOffset()
+	}
+	if offset > int64(len(file)) {
+		offset = int64(len(file))
+	}
+	line := bytes.Count(file[:offset], []byte("\n")) + 1
+	return fmt.Errorf("line %d: %+v", line, err)
+}
+
+func parseYAML(file []byte) ([]Bag, error) {
+	var bags []Bag
+
+	// each document is either a single bag or a list of them
+	decoder := yaml.NewDecoder(bytes.NewReader(file))
+	for {
+		var document yaml.Node
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(document.Content) == 0 {
+			continue
+		}
+
+		if document.Content[0].Kind == yaml.SequenceNode {
+			var list []Bag
+			if err = document.Decode(&list); err != nil {
+				return nil, err
+			}
+			bags = append(bags, list...)
+		} else {
+			var bag Bag
+			if err = document.Decode(&bag); err != nil {
+				return nil, err
+			}
+			bags = append(bags, bag)
+		}
+	}
+
+	return bags, nil
+}
+
+func parseTOML(file []byte) ([]Bag, error) {
+	// toml documents are always a table, so multiple bags have to live under a key
+	var list struct {
+		Bags []Bag `toml:"bags"`
+	}
+	metadata, err := toml.Decode(string(file), &list)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.IsDefined("bags") {
+		return list.Bags, nil
+	}
+
+	var bag Bag
+	if _, err = toml.Decode(string(file), &bag); err != nil {
+		return nil, err
+	}
+	return []Bag{bag}, nil
+}
+
+// read the file of header changes made on each listener, keyed by listener name
+// json is valid yaml, so the one decoder takes care of both
+func ParseListenerHeaders(filename string) (map[string]Headers, error) {
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR - couldn't read file: %s\n", err)
+	}
+
+	headers := make(map[string]Headers)
+	decoder := yaml.NewDecoder(bytes.NewReader(file))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&headers); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %+v", filename, err)
+	}
+	return headers, nil
+}
@@ -0,0 +1,270 @@
+package usercfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+)
+
+// patches for the bags of one environment, keyed by bag id
+// a patch has the same shape as a bag, but only holds the fields the environment changes
+type Overlay map[string]map[string]interface{}
+
+// turn overlay file into patches, it's laid out the same way as a databag file of its format
+// every bag in it needs the id of the bag it patches
+func ParseOverlayFile(filename string) (Overlay, error) {
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR - couldn't read file: %s\n", err)
+	}
+
+	documents, err := decodeDocuments(file, fileFormat(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %+v", filename, err)
+	}
+
+	overlay := make(Overlay)
+	for i, doc := range documents {
+		patch, ok := doc.value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: overlay %d must be an object", filename, i)
+		}
+		id, _ := patch["id"].(string)
+		if id == "" {
+			return nil, fmt.Errorf("%s: overlay %d has no bag id", filename, i)
+		}
+		if _, ok := overlay[id]; ok {
+			return nil, fmt.Errorf("%s: duplicate overlay for bag %s", filename, id)
+		}
+		overlay[id] = patch
+	}
+	return overlay, nil
+}
+
+// combine overlays from several files, a bag can only be patched by one of them
+func MergeOverlays(overlays map[string]Overlay) (Overlay, error) {
+	var filenames []string
+	for filename := range overlays {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	merged := make(Overlay)
+	patchedBy := make(map[string]string)
+	for _, filename := range filenames {
+		for id, patch := range overlays[filename] {
+			if other, ok := patchedBy[id]; ok {
+				return nil, fmt.Errorf("bag %s has overlays in both %s and %s", id, other, filename)
+			}
+			merged[id] = patch
+			patchedBy[id] = filename
+		}
+	}
+	return merged, nil
+}
+
+// same as ParseFile, but bags with a patch in the overlay get it merged in
+// patched bags are validated against the databag schema again, since the overlay could have broken them
+func ParseFileWithOverlay(filename string, overlay Overlay) ([]Bag, error) {
+	bags, err := ParseFile(filename)
+	if err != nil || len(overlay) == 0 {
+		return bags, err
+	}
+
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR - couldn't read file: %s\n", err)
+	}
+	documents, err := decodeDocuments(file, fileFormat(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %+v", filename, err)
+	}
+	if len(documents) != len(bags) {
+		return nil, fmt.Errorf("%s: found %d bags, but %d documents", filename, len(bags), len(documents))
+	}
+
+	for i, bag := range bags {
+		patch, ok := overlay[bag.Id]
+		if bag.Id == "" || !ok {
+			continue
+		}
+		// line numbers of the original file don't mean much once the overlay has moved things around
+		value, err := mergeBag(documents[i].value, patch)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s overlay: %+v", filename, bag.Id, err)
+		}
+		merged := document{value: value, lines: make(map[string]int)}
+		if err = validateDocuments(fmt.Sprintf("%s (%s overlay)", filename, bag.Id), []document{merged}); err != nil {
+			return nil, err
+		}
+		encoded, err := json.Marshal(merged.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s overlay: %+v", filename, bag.Id, err)
+		}
+		bags[i] = Bag{}
+		if err = json.Unmarshal(encoded, &bags[i]); err != nil {
+			return nil, fmt.Errorf("%s: %s overlay: %+v", filename, bag.Id, err)
+		}
+	}
+	return bags, nil
+}
+
+// helper: merge a patch into a bag's plain values
+// backends are patched one by one so an environment can change just one backend's endpoints, everything else is a json merge patch
+func mergeBag(value interface{}, patch map[string]interface{}) (interface{}, error) {
+	backends, ok := patch["backends"].([]interface{})
+	if !ok {
+		return mergePatch(value, patch), nil
+	}
+	rest := make(map[string]interface{})
+	for k, field := range patch {
+		if k != "backends" {
+			rest[k] = field
+		}
+	}
+	merged := mergePatch(value, rest).(map[string]interface{})
+	original, _ := merged["backends"].([]interface{})
+	patched, err := mergeBackends(original, backends)
+	if err != nil {
+		return nil, err
+	}
+	merged["backends"] = patched
+	return merged, nil
+}
+
+// helper: patch each backend with the patch whose match picks it out, the backend without a pattern is the bag's default one
+// a patch's match only has to hold enough of the backend's match (e.g. just the path pattern) to pick out a single backend,
+// so reordering the bag's backends can't patch the wrong one, and backends sharing a path are told apart by their other conditions
+func mergeBackends(backends []interface{}, patches []interface{}) ([]interface{}, error) {
+	merged := append([]interface{}(nil), backends...)
+	patched := make(map[int]bool)
+	for i, patch := range patches {
+		object, ok := patch.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("backend patch %d must be an object", i)
+		}
+		var picked []int
+		for j, backend := range backends {
+			if picks(object, backend) {
+				picked = append(picked, j)
+			}
+		}
+		switch {
+		case len(picked) == 0:
+			return nil, fmt.Errorf("no backend %s to patch", selector(object))
+		case len(picked) > 1:
+			return nil, fmt.Errorf("several backends %s, add more of their match conditions to the patch to tell them apart", selector(object))
+		case patched[picked[0]]:
+			return nil, fmt.Errorf("backend %s is patched twice", selector(object))
+		}
+		patched[picked[0]] = true
+		// the match only picks the backend, it isn't merged into it
+		fields := make(map[string]interface{})
+		for k, field := range object {
+			if k != "match" {
+				fields[k] = field
+			}
+		}
+		merged[picked[0]] = mergePatch(merged[picked[0]], fields)
+	}
+	return merged, nil
+}
+
+// helper: check if a patch picks out a backend, the path patterns have to be the same and the rest of the patch's match has to be in the backend's
+func picks(patch map[string]interface{}, backend interface{}) bool {
+	if backendPattern(patch) != backendPattern(backend) {
+		return false
+	}
+	b, _ := backend.(map[string]interface{})
+	return holds(b["match"], patch["match"])
+}
+
+// helper: check if plain values hold everything in the selector, objects can have fields the selector leaves out
+// lists have to hold the same elements, in any order
+func holds(value interface{}, selector interface{}) bool {
+	switch s := selector.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		v, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, field := range s {
+			if !holds(v[k], field) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		v, ok := value.([]interface{})
+		if !ok || len(v) != len(s) {
+			return false
+		}
+		used := make(map[int]bool)
+		for _, element := range s {
+			found := false
+			for i := range v {
+				if !used[i] && holds(v[i], element) {
+					used[i], found = true, true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(value, selector)
+	}
+}
+
+// helper: describe the backends a patch picks, for errors
+func selector(patch map[string]interface{}) string {
+	match, ok := patch["match"]
+	if !ok {
+		return "without a path pattern"
+	}
+	encoded, _ := json.Marshal(match)
+	return fmt.Sprintf("with the match %s", encoded)
+}
+
+// helper: path pattern of a backend in its plain values, empty for the default backend
+func backendPattern(backend interface{}) string {
+	value := backend
+	for _, key := range []string{"match", "path", "pattern"} {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+	pattern, _ := value.(string)
+	return pattern
+}
+
+// helper: merge a patch into plain values, the same way as a json merge patch
+// objects are merged field by field and null removes a field, anything else replaces what was there
+func mergePatch(value interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	merged := make(map[string]interface{})
+	if v, ok := value.(map[string]interface{}); ok {
+		for k, field := range v {
+			merged[k] = field
+		}
+	}
+	for k, field := range p {
+		if field == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = mergePatch(merged[k], field)
+		}
+	}
+	return merged
+}
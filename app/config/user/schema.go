@@ -0,0 +1,563 @@
+package usercfg
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	toml "github.com/BurntSushi/toml"
+	jsonschema "github.com/santhosh-tekuri/jsonschema/v5"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// published json schema every databag gets checked against, regardless of file format
+//
+//go:embed databag.schema.json
+var schemaSource string
+
+var schema = jsonschema.MustCompileString("databag.schema.json", schemaSource)
+
+// a single bag decoded into plain values, plus the line each value starts on
+type document struct {
+	value interface{}    // bag as plain json values
+	lines map[string]int // field path -> line number
+}
+
+// a problem found while validating a bag
+type problem struct {
+	line    int    // 0 if we don't know the line
+	path    string // field path within the bag (e.g. "backends[2].match.path.type")
+	message string // what's wrong with the field
+}
+
+// check every bag in a file against the databag schema
+// all problems are reported at once, one per line of the returned error
+func validateFile(filename string, file []byte, format string) error {
+	documents, err := decodeDocuments(file, format)
+	if err != nil {
+		return fmt.Errorf("%s: %+v", filename, err)
+	}
+	return validateDocuments(filename, documents)
+}
+
+// split a file into its bags as plain values, the way its format lays them out
+func decodeDocuments(file []byte, format string) ([]document, error) {
+	switch format {
+	case "yaml":
+		return yamlDocuments(file)
+	case "toml":
+		return tomlDocuments(file)
+	default:
+		return jsonDocuments(file)
+	}
+}
+
+// check already decoded bags against the databag schema, errors point at the given file
+func validateDocuments(filename string, documents []document) error {
+	var problems []problem
+	for _, doc := range documents {
+		err := schema.Validate(doc.value)
+		if err == nil {
+			continue
+		}
+		validationErr, ok := err.(*jsonschema.ValidationError)
+		if !ok {
+			return fmt.Errorf("%s: %+v", filename, err)
+		}
+		for _, leaf := range leafErrors(validationErr) {
+			path := fieldPath(leaf.InstanceLocation)
+			// unknown keys are reported on the object holding them, point at the keys themselves instead
+			if strings.HasSuffix(leaf.KeywordLocation, "/additionalProperties") {
+				for _, key := range unknownKeys(leaf.Message) {
+					keyPath := joinPath(path, key)
+					problems = append(problems, problem{
+						line:    doc.lines[keyPath],
+						path:    keyPath,
+						message: "unknown field",
+					})
+				}
+				continue
+			}
+			problems = append(problems, problem{
+				line:    doc.lines[path],
+				path:    path,
+				message: leaf.Message,
+			})
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+	var messages []string
+	for _, p := range problems {
+		location := filename
+		if p.line != 0 {
+			location = fmt.Sprintf("%s:%d", filename, p.line)
+		}
+		if p.path == "" {
+			messages = append(messages, fmt.Sprintf("%s: %s", location, p.message))
+		} else {
+			messages = append(messages, fmt.Sprintf("%s: %s: %s", location, p.path, p.message))
+		}
+	}
+	return fmt.Errorf("invalid databag:\n%s", strings.Join(messages, "\n"))
+}
+
+// helper: the schema library nests errors, we only care about the ones that point at a field
+func leafErrors(err *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(err.Causes) == 0 {
+		return []*jsonschema.ValidationError{err}
+	}
+	var leaves []*jsonschema.ValidationError
+	for _, cause := range err.Causes {
+		leaves = append(leaves, leafErrors(cause)...)
+	}
+	return leaves
+}
+
+// helper: names of the keys an additionalProperties error complains about ("additionalProperties 'a', 'b' not allowed")
+func unknownKeys(message string) []string {
+	var keys []string
+	for _, match := range quotedKey.FindAllStringSubmatch(message, -1) {
+		keys = append(keys, match[1])
+	}
+	return keys
+}
+
+var quotedKey = regexp.MustCompile(`'([^']*)'`)
+
+// helper: turn a json pointer ("/backends/2/match") into a field path ("backends[2].match")
+func fieldPath(pointer string) string {
+	var path string
+	for _, segment := range strings.Split(pointer, "/")[1:] {
+		segment = strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+		if _, err := strconv.Atoi(segment); err == nil {
+			path += "[" + segment + "]"
+		} else {
+			path = joinPath(path, segment)
+		}
+	}
+	return path
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// split a json file into its bags, keeping track of the line every value is on
+func jsonDocuments(file []byte) ([]document, error) {
+	decoder := json.NewDecoder(bytes.NewReader(file))
+	decoder.UseNumber()
+
+	// a json array holds every bag in the file, so step inside it
+	if trimmed := bytes.TrimSpace(file); len(trimmed) > 0 && trimmed[0] == '[' {
+		if _, err := decoder.Token(); err != nil {
+			return nil, jsonError(file, decoder, err)
+		}
+	}
+
+	var documents []document
+	for decoder.More() {
+		doc := document{lines: make(map[string]int)}
+		value, err := jsonValue(file, decoder, "", doc.lines)
+		if err != nil {
+			return nil, jsonError(file, decoder, err)
+		}
+		doc.value = value
+		documents = append(documents, doc)
+	}
+
+	return documents, nil
+}
+
+// helper: decode the next json value one token at a time, recording where each field starts
+// fields of an object are recorded on the line of their key
+func jsonValue(file []byte, decoder *json.Decoder, path string, lines map[string]int) (interface{}, error) {
+	lines[path] = nextLine(file, decoder)
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		object := make(map[string]interface{})
+		for decoder.More() {
+			line := nextLine(file, decoder)
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			keyPath := joinPath(path, key.(string))
+			object[key.(string)], err = jsonValue(file, decoder, keyPath, lines)
+			if err != nil {
+				return nil, err
+			}
+			lines[keyPath] = line
+		}
+		_, err = decoder.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for i := 0; decoder.More(); i++ {
+			value, err := jsonValue(file, decoder, fmt.Sprintf("%s[%d]", path, i), lines)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err = decoder.Token()
+		return array, err
+	default:
+		return token, nil
+	}
+}
+
+// helper: line of the next json token
+func nextLine(file []byte, decoder *json.Decoder) int {
+	// the decoder sits right after the previous token, skip ahead to where the next one starts
+	offset := int(decoder.InputOffset())
+	for offset < len(file) && strings.IndexByte(" \t\r\n,:", file[offset]) != -1 {
+		offset++
+	}
+	return bytes.Count(file[:offset], []byte("\n")) + 1
+}
+
+// split a yaml file into its bags, keeping track of the line every value is on
+func yamlDocuments(file []byte) ([]document, error) {
+	var documents []document
+
+	decoder := yaml.NewDecoder(bytes.NewReader(file))
+	for {
+		var root yaml.Node
+		if err := decoder.Decode(&root); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if len(root.Content) == 0 {
+			continue
+		}
+
+		// each document is either a single bag or a list of them
+		nodes := []*yaml.Node{root.Content[0]}
+		if root.Content[0].Kind == yaml.SequenceNode {
+			nodes = root.Content[0].Content
+		}
+		for _, node := range nodes {
+			doc := document{lines: make(map[string]int)}
+			yamlLines(node, "", doc.lines)
+
+			var value interface{}
+			if err := node.Decode(&value); err != nil {
+				return nil, err
+			}
+			plain, err := plainValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %+v", node.Line, err)
+			}
+			doc.value = plain
+			documents = append(documents, doc)
+		}
+	}
+
+	return documents, nil
+}
+
+// helper: record the line of every value in a yaml node, fields of a mapping are recorded on the line of their key
+func yamlLines(node *yaml.Node, path string, lines map[string]int) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	lines[path] = node.Line
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := joinPath(path, node.Content[i].Value)
+			yamlLines(node.Content[i+1], keyPath, lines)
+			lines[keyPath] = node.Content[i].Line
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			yamlLines(child, fmt.Sprintf("%s[%d]", path, i), lines)
+		}
+	}
+}
+
+// split a toml file into its bags, the decoder keeps its key positions to itself so we scan for lines ourselves
+func tomlDocuments(file []byte) ([]document, error) {
+	var root map[string]interface{}
+	if _, err := toml.Decode(string(file), &root); err != nil {
+		return nil, err
+	}
+	lines := tomlLines(string(file))
+
+	values := []interface{}{root}
+	prefixes := []string{""}
+	if bags, ok := root["bags"]; ok {
+		list, ok := bags.([]map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("bags must be an array of tables")
+		}
+		values, prefixes = nil, nil
+		for i, bag := range list {
+			values = append(values, bag)
+			prefixes = append(prefixes, fmt.Sprintf("bags[%d]", i))
+		}
+	}
+
+	var documents []document
+	for i, value := range values {
+		plain, err := plainValue(value)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document{value: plain, lines: tomlBagLines(lines, prefixes[i])})
+	}
+	return documents, nil
+}
+
+// helper: the lines of a single bag, with paths relative to the bag
+func tomlBagLines(lines map[string]int, prefix string) map[string]int {
+	if prefix == "" {
+		return lines
+	}
+	bag := make(map[string]int)
+	for path, line := range lines {
+		if path == prefix {
+			bag[""] = line
+		} else if strings.HasPrefix(path, prefix+".") {
+			bag[strings.TrimPrefix(path, prefix+".")] = line
+		}
+	}
+	return bag
+}
+
+// helper: record the line of every key, table and array element in a toml file, the file has already been decoded so it's valid
+func tomlLines(text string) map[string]int {
+	s := &tomlScanner{text: text, line: 1, lines: make(map[string]int), tables: make(map[string]int)}
+	table := ""
+	for {
+		s.skipSpace(true)
+		if s.done() {
+			return s.lines
+		}
+		switch {
+		case strings.HasPrefix(s.text[s.pos:], "[["):
+			// every [[name]] adds a table to the array, keys below it belong to the newest one
+			s.pos += 2
+			keys := s.key("]")
+			s.pos += 2
+			name := joinPath(s.resolve(keys[:len(keys)-1]), keys[len(keys)-1])
+			table = fmt.Sprintf("%s[%d]", name, s.tables[name])
+			s.tables[name]++
+			s.lines[table] = s.line
+		case s.text[s.pos] == '[':
+			s.pos++
+			table = s.resolve(s.key("]"))
+			s.pos++
+			s.lines[table] = s.line
+		default:
+			s.keyValue(table)
+		}
+	}
+}
+
+// just enough of a toml reader to know which line every path starts on
+type tomlScanner struct {
+	text   string
+	pos    int
+	line   int
+	lines  map[string]int // field path -> line number
+	tables map[string]int // array of tables -> how many tables it has so far
+}
+
+func (s *tomlScanner) done() bool {
+	return s.pos >= len(s.text)
+}
+
+// helper: step over whitespace and comments, newlines only where toml allows them
+func (s *tomlScanner) skipSpace(newlines bool) {
+	for !s.done() {
+		switch s.text[s.pos] {
+		case ' ', '\t', '\r':
+			s.pos++
+		case '\n':
+			if !newlines {
+				return
+			}
+			s.line++
+			s.pos++
+		case '#':
+			for !s.done() && s.text[s.pos] != '\n' {
+				s.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// helper: read a (dotted) key up to the given terminator, quotes are stripped
+func (s *tomlScanner) key(terminator string) []string {
+	var keys []string
+	var current strings.Builder
+	for !s.done() && !strings.HasPrefix(s.text[s.pos:], terminator) {
+		switch c := s.text[s.pos]; c {
+		case '"', '\'':
+			start := s.pos
+			s.skipString()
+			unquoted, err := strconv.Unquote(s.text[start:s.pos])
+			if err != nil || c == '\'' {
+				unquoted = s.text[start+1 : s.pos-1]
+			}
+			current.WriteString(unquoted)
+		case '.':
+			keys = append(keys, current.String())
+			current.Reset()
+			s.pos++
+		case ' ', '\t':
+			s.pos++
+		default:
+			current.WriteByte(c)
+			s.pos++
+		}
+	}
+	return append(keys, current.String())
+}
+
+// helper: point the keys of a table header at the newest table of any array of tables along the way
+func (s *tomlScanner) resolve(keys []string) string {
+	var path string
+	for _, key := range keys {
+		path = joinPath(path, key)
+		if count, ok := s.tables[path]; ok {
+			path = fmt.Sprintf("%s[%d]", path, count-1)
+		}
+	}
+	return path
+}
+
+// helper: a key = value pair within the given table, fields are recorded on the line of their key
+func (s *tomlScanner) keyValue(table string) {
+	line := s.line
+	path := table
+	for _, key := range s.key("=") {
+		path = joinPath(path, key)
+	}
+	s.lines[path] = line
+	s.pos++
+	s.skipSpace(false)
+	s.value(path)
+}
+
+// helper: step over a value, recording the lines of whatever it holds
+func (s *tomlScanner) value(path string) {
+	if s.done() {
+		return
+	}
+	switch s.text[s.pos] {
+	case '{':
+		s.pos++
+		for {
+			s.skipSpace(true)
+			if s.done() {
+				return
+			}
+			switch s.text[s.pos] {
+			case '}':
+				s.pos++
+				return
+			case ',':
+				s.pos++
+			default:
+				s.keyValue(path)
+			}
+		}
+	case '[':
+		s.pos++
+		for i := 0; ; {
+			s.skipSpace(true)
+			if s.done() {
+				return
+			}
+			switch s.text[s.pos] {
+			case ']':
+				s.pos++
+				return
+			case ',':
+				s.pos++
+			default:
+				element := fmt.Sprintf("%s[%d]", path, i)
+				s.lines[element] = s.line
+				s.value(element)
+				i++
+			}
+		}
+	case '"', '\'':
+		s.skipString()
+	default:
+		for !s.done() && strings.IndexByte(",]}\n#", s.text[s.pos]) == -1 {
+			s.pos++
+		}
+	}
+}
+
+// helper: step over a basic or literal string, multi-line ones included
+func (s *tomlScanner) skipString() {
+	quote := s.text[s.pos : s.pos+1]
+	if strings.HasPrefix(s.text[s.pos:], quote+quote+quote) {
+		quote += quote + quote
+	}
+	s.pos += len(quote)
+	for !s.done() {
+		switch {
+		case strings.HasPrefix(s.text[s.pos:], quote):
+			s.pos += len(quote)
+			// a multi-line string can end in up to two extra quotes
+			for len(quote) == 3 && !s.done() && s.text[s.pos] == quote[0] {
+				s.pos++
+			}
+			return
+		case s.text[s.pos] == '\\' && quote[0] == '"':
+			// escapes can't hide a quote, but they can hide a newline
+			if strings.HasPrefix(s.text[s.pos:], "\\\n") {
+				s.line++
+			}
+			s.pos += 2
+		case s.text[s.pos] == '\n':
+			s.line++
+			s.pos++
+		default:
+			s.pos++
+		}
+	}
+}
+
+// helper: yaml and toml decode into go types the schema library doesn't know about, so round trip through json
+func plainValue(value interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+
+	var plain interface{}
+	err = decoder.Decode(&plain)
+	return plain, err
+}
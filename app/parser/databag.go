@@ -1,12 +1,18 @@
 package parser
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"net"
 	"net/url"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	univcfg "github.com/fmgornick/dynamic-proxy/app/config/universal"
 	usercfg "github.com/fmgornick/dynamic-proxy/app/config/user"
@@ -26,12 +32,67 @@ var schemes map[string]uint = map[string]uint{
 	"telnet": 23,
 }
 
+// units haproxy durations can be given in, no unit means seconds (unlike haproxy)
+var durationUnits map[string]time.Duration = map[string]time.Duration{
+	"":   time.Second,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+}
+
+var durationFormat = regexp.MustCompile(`^([0-9]+)(us|ms|s|m|h|d)?$`)
+
+// conditions envoy can retry http requests on
+var retryOn map[string]bool = map[string]bool{
+	"5xx":                    true,
+	"gateway-error":          true,
+	"reset":                  true,
+	"connect-failure":        true,
+	"envoy-ratelimited":      true,
+	"retriable-4xx":          true,
+	"refused-stream":         true,
+	"retriable-status-codes": true,
+	"retriable-headers":      true,
+}
+
+// http methods envoy can send health checks with
+var methods map[string]bool = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"DELETE":  true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PATCH":   true,
+}
+
+// haproxy balance algorithms that map straight onto a load balancing policy
 var policy map[string]string = map[string]string{
-	"":          "round_robin",
-	"static-rr": "round_robin",
-	"leastconn": "least_request",
+	"":           "round_robin",
+	"roundrobin": "round_robin",
+	"static-rr":  "round_robin",
+	"leastconn":  "least_request",
+	"random":     "random",
+	"first":      "first",
+}
+
+// haproxy balance algorithms that hash part of the request, so the same client keeps hitting the same endpoint
+// the ones in the second group take the name of what they hash on in parentheses (e.g. "hdr(x-user-id)")
+var hashPolicy map[string]string = map[string]string{
+	"source": "source_ip",
+	"uri":    "path",
+
+	"hdr":        "header",
+	"url_param":  "query_param",
+	"rdp-cookie": "cookie",
 }
 
+var balanceFormat = regexp.MustCompile(`^([a-z_-]+)(?:\(([^()]+)\))?$`)
+
 // parser has all the databags and an instance of our resource
 // uses the databags to create the resource
 type BagParser struct {
@@ -45,10 +106,22 @@ type BagParser struct {
 func Parse(bags []usercfg.Bag, l univcfg.ListenerInfo) (*univcfg.Config, error) {
 	// initialize bag parser variables
 	var bp BagParser
-	bp.Bags = bags
 	bp.Config = *univcfg.NewConfig()
 	bp.ListenerInfo = l
 
+	// skip bags that aren't available on any listener we're running
+	for _, bag := range bags {
+		zones, err := bagZones(bag)
+		if err != nil {
+			return nil, err
+		}
+		if zones == univcfg.GCP_EXTERNAL && l.GcpPort == 0 {
+			fmt.Printf("skipping bag %s: only available on gcp-external, which has no listener\n", bag.Id)
+			continue
+		}
+		bp.Bags = append(bp.Bags, bag)
+	}
+
 	var err error
 	err = bp.AddListeners()
 	if err != nil {
@@ -74,9 +147,19 @@ func Parse(bags []usercfg.Bag, l univcfg.ListenerInfo) (*univcfg.Config, error)
 // add listeners to listener map
 func (bp *BagParser) AddListeners() error {
 	info := bp.ListenerInfo
-	// if given data bags, then it's assumed there will only be 2 listeners
+	// if given data bags, then it's assumed there will be a listener per zone
 	bp.Config.AddListener(info.InternalAddress, "internal", info.InternalPort, info.InternalCommonName)
 	bp.Config.AddListener(info.ExternalAddress, "external", info.ExternalPort, info.ExternalCommonName)
+	// gcp-external listener is optional, only add it if we were given a port
+	if info.GcpPort != 0 {
+		bp.Config.AddListener(info.GcpAddress, "gcp-external", info.GcpPort, info.GcpCommonName)
+	}
+	for name, l := range bp.Config.Listeners {
+		l.GroupsHeader = info.GroupsHeader
+		l.GroupsTrustedCidrs = info.GroupsTrustedCidrs
+		l.HeaderRules = info.HeaderRules[name]
+		l.RateLimits = info.RateLimitService != ""
+	}
 	return nil
 }
 
@@ -87,14 +170,89 @@ func (bp *BagParser) AddClusters() error {
 			// create cluster name from bag id / path
 			clusterName, err := getClusterName(bag, backend)
 			if err != nil {
-				if err.Error() == "found gcp-external only api: "+bag.Id {
-					break
-				} else {
+				return err
+			}
+			healthcheck, err := convertHealthCheck(backend.HealthCheck)
+			if err != nil {
+				return err
+			}
+			connectTimeout, err := parseDuration(backend.Timeouts.Connect, 0)
+			if err != nil {
+				return err
+			}
+			lbPolicy, _, err := convertBalance(backend.Balance)
+			if err != nil {
+				return err
+			}
+			outlier, err := convertOutlier(backend.Outlier)
+			if err != nil {
+				return err
+			}
+			breaker := convertBreaker(backend.Breaker)
+			dnsType, err := convertDns(backend)
+			if err != nil {
+				return err
+			}
+
+			// splits are load balanced and health checked the same way as the backend's main servers
+			names := []string{clusterName}
+			servers := []usercfg.Server{backend.Server}
+			for _, split := range backend.Splits {
+				names = append(names, univcfg.SplitName(clusterName, split.Name))
+				servers = append(servers, split.Server)
+			}
+			usesTls := false
+			for i, name := range names {
+				upstreamTls, err := convertTls(backend.Tls, servers[i].Endpoints, bp.ListenerInfo.UpstreamTls)
+				if err != nil {
+					return err
+				}
+				usesTls = usesTls || upstreamTls != nil
+				c, err := bp.Config.AddCluster(name, lbPolicy, healthcheck)
+				if err != nil {
 					return err
 				}
+				c.ConnectTimeout = connectTimeout
+				c.CircuitBreaker = breaker
+				c.OutlierDetection = outlier
+				c.DnsType = dnsType
+				c.Tls = upstreamTls
+			}
+			if !usesTls && hasTlsSettings(backend.Tls) {
+				return fmt.Errorf("tls settings given, but none of the endpoints use https")
 			}
-			healthcheck := convertHealthCheck(backend.HealthCheck)
-			bp.Config.AddCluster(clusterName, policy[backend.Balance], healthcheck)
+		}
+	}
+	return nil
+}
+
+// helper: make sure the rate limit service can keep a per key limit
+// the service only limits counts it has a rule for, anything else would silently go unlimited
+func checkRateLimitService(rl *univcfg.RateLimit, clusterName string, info univcfg.ListenerInfo) error {
+	if info.RateLimitService == "" {
+		return fmt.Errorf("%s rate limit on %s needs a rate limit service (-ratelimit-service)", rl.Field, clusterName)
+	}
+	for _, count := range info.RateLimitCounts {
+		if count == rl.Count {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s rate limit on %s has a count of %d, which the rate limit service has no rule for (-ratelimit-counts)", rl.Field, clusterName, rl.Count)
+}
+
+// helper: make sure a bag's groups can actually be checked
+// without a groups header the routes would be open to everyone, so that's an error rather than a silent downgrade
+func checkGroups(bag usercfg.Bag, header string) error {
+	if len(bag.Groups) == 0 {
+		return nil
+	}
+	if header == "" {
+		return fmt.Errorf("bag %s has groups, but group checks are turned off (empty -groups-header)", bag.Id)
+	}
+	for _, group := range bag.Groups {
+		// the groups header is a semicolon separated list
+		if strings.Contains(group, ";") {
+			return fmt.Errorf("group can't contain a semicolon: %s", group)
 		}
 	}
 	return nil
@@ -104,47 +262,104 @@ func (bp *BagParser) AddClusters() error {
 // add routes to route map
 func (bp *BagParser) AddRoutes() error {
 	for _, bag := range bp.Bags {
+		if err := checkGroups(bag, bp.ListenerInfo.GroupsHeader); err != nil {
+			return err
+		}
 		for _, backend := range bag.Backends {
 			clusterName, err := getClusterName(bag, backend)
 			if err != nil {
-				if err.Error() == "found gcp-external only api: "+bag.Id {
-					break
-				} else {
+				return err
+			}
+			rateLimit, err := convertRateLimit(backend.RateLimit)
+			if err != nil {
+				return err
+			}
+			if rateLimit != nil && rateLimit.PerKey() {
+				if err = checkRateLimitService(rateLimit, clusterName, bp.ListenerInfo); err != nil {
 					return err
 				}
 			}
 			// check if specific path provided, otherwise get path from bag id
+			var r *univcfg.Route
 			bagPath := "/" + strings.Replace(bag.Id, "-", "/", -1)
 			if backend.Match.Path.Pattern == "" {
-				bp.Config.AddRoute(clusterName, bagPath, "starts_with")
+				r, err = bp.Config.AddRoute(clusterName, bagPath, "starts_with", rateLimit)
 			} else {
 				if !strings.HasPrefix(backend.Match.Path.Pattern, bagPath) && backend.IgnoreDefault != true {
 					return fmt.Errorf("path pattern must start with \"%s\", or set ignore default", bagPath)
 				} else if backend.Match.Path.Type == "" {
-					bp.Config.AddRoute(clusterName, backend.Match.Path.Pattern, "starts_with")
+					r, err = bp.Config.AddRoute(clusterName, backend.Match.Path.Pattern, "starts_with", rateLimit)
 				} else {
-					bp.Config.AddRoute(clusterName, backend.Match.Path.Pattern, backend.Match.Path.Type)
+					r, err = bp.Config.AddRoute(clusterName, backend.Match.Path.Pattern, backend.Match.Path.Type, rateLimit)
 				}
 			}
+			if err != nil {
+				return err
+			}
+			// only members of the bag's groups can access its routes
+			r.Groups = bag.Groups
+			basePath, err := backendBasePath(backend)
+			if err != nil {
+				return err
+			}
+			r.PrefixRewrite, r.RegexRewrite, err = convertRewrite(backend.Rewrite, r.Type, basePath)
+			if err != nil {
+				return err
+			}
+			r.Timeout, err = parseDuration(backend.Timeouts.Request, 0)
+			if err != nil {
+				return err
+			}
+			r.IdleTimeout, err = parseDuration(backend.Timeouts.Idle, 0)
+			if err != nil {
+				return err
+			}
+			r.Retry, err = convertRetry(backend.Retry)
+			if err != nil {
+				return err
+			}
+			r.Splits, err = convertSplits(clusterName, backend)
+			if err != nil {
+				return err
+			}
+			r.HeaderRules, err = convertHeaderRules(bag.Headers, backend.Headers)
+			if err != nil {
+				return err
+			}
+			r.Cors, err = convertCors(bag.Cors, backend.Cors)
+			if err != nil {
+				return err
+			}
+			_, r.HashPolicy, err = convertBalance(backend.Balance)
+			if err != nil {
+				return err
+			}
+			r.Direct, r.Redirect, err = convertResponse(bag, backend)
+			if err != nil {
+				return err
+			}
+			r.Headers, r.QueryParams, r.Methods, err = convertMatchConditions(backend.Match)
+			if err != nil {
+				return err
+			}
 		}
 	}
-	// add the strictly internal or external routes to our listener route array
-	for name, route := range bp.Config.Routes {
-		if route.Availability == uint8(univcfg.INTERNAL) {
-			bp.Config.Listeners["internal"].Routes = append(bp.Config.Listeners["internal"].Routes, name)
-		} else if route.Availability == uint8(univcfg.EXTERNAL) {
-			bp.Config.Listeners["external"].Routes = append(bp.Config.Listeners["external"].Routes, name)
-		}
+	// add each route to the route array of every listener it's available on
+	// if a more specific route with the same path exists for that listener, then that route wins
+	names := make([]string, 0, len(bp.Config.Routes))
+	for name := range bp.Config.Routes {
+		names = append(names, name)
 	}
-	// now add the "available for both" routes if their more specific route isn't already in the array
-	for name, route := range bp.Config.Routes {
-		if route.Availability == uint8(univcfg.BOTH) {
-			if bp.Config.Routes[name[:len(name)-2]+"in"] == nil {
-				bp.Config.Listeners["internal"].Routes = append(bp.Config.Listeners["internal"].Routes, name)
-			}
-			if bp.Config.Routes[name[:len(name)-2]+"ex"] == nil {
-				bp.Config.Listeners["external"].Routes = append(bp.Config.Listeners["external"].Routes, name)
+	univcfg.SortRoutes(names, bp.Config.Routes)
+	for _, name := range names {
+		route := bp.Config.Routes[name]
+		for _, zone := range univcfg.Zones {
+			l := bp.Config.Listeners[zone]
+			mask := univcfg.ZoneMasks[zone]
+			if l == nil || route.Availability&mask == 0 || bp.moreSpecificRoute(name, mask) {
+				continue
 			}
+			l.Routes = append(l.Routes, name)
 		}
 	}
 	return nil
@@ -157,65 +372,126 @@ func (bp *BagParser) AddEndpoints() error {
 			// retrieve name of cluster the endpoint maps to
 			clusterName, err := getClusterName(bag, backend)
 			if err != nil {
-				if err.Error() == "found gcp-external only api: "+bag.Id {
-					break
-				} else {
-					return err
-				}
+				return err
 			}
-			// if server doesn't have any endpoints, then we don't want to delete the cluster
+			// a server without endpoints has no cluster, its route answers requests itself or only uses splits
 			if len(backend.Server.Endpoints) == 0 {
 				delete(bp.Config.Clusters, clusterName)
 			}
-			for _, endpoint := range backend.Server.Endpoints {
-				// check if a port is specified in the url
-				// if there is a route, then assign it to our port variable and remove it from the address string
-				// otherwise, just leave the address as is and assign as 80
-				var address string
-				var port uint
-
-				var addr string
-				if strings.Contains(endpoint.Address, "://") {
-					addr = endpoint.Address
-				} else {
-					addr = "https://" + endpoint.Address
+			err = bp.addEndpoints(clusterName, backend.Server.Endpoints, backend.HealthCheck.Port)
+			if err != nil {
+				return err
+			}
+			for _, split := range backend.Splits {
+				if len(split.Server.Endpoints) == 0 {
+					return fmt.Errorf("split %s has no endpoints", split.Name)
 				}
-
-				u, err := url.Parse(addr)
+				err = bp.addEndpoints(univcfg.SplitName(clusterName, split.Name), split.Server.Endpoints, backend.HealthCheck.Port)
 				if err != nil {
-					return fmt.Errorf("error parsing url: %+v", err)
-				}
-				if _, ok := schemes[u.Scheme]; !ok {
-					return fmt.Errorf("invalid schema: %s", u.Scheme)
-				}
-
-				address = u.Hostname() + u.Path
-				if address[len(address)-1] == '/' {
-					address = address[:len(address)-1]
-				}
-				portString := u.Port()
-				if portString == "" {
-					if endpoint.Port == 0 {
-						port = uint(schemes[u.Scheme])
-					} else {
-						port = endpoint.Port
-					}
-				} else {
-					p, _ := strconv.Atoi(portString)
-					port = uint(p)
+					return err
 				}
-				// add endpoints to endpoint map
-				bp.Config.AddEndpoint(address, clusterName, port, endpoint.Region, endpoint.Weight)
 			}
 		}
 	}
 	return nil
 }
 
+// helper: add a server's endpoints to a cluster
+func (bp *BagParser) addEndpoints(clusterName string, endpoints []usercfg.Endpoint, healthCheckPort uint) error {
+	for _, endpoint := range endpoints {
+		address, port, _, err := parseEndpoint(endpoint)
+		if err != nil {
+			return err
+		}
+		// add endpoints to endpoint map
+		e := bp.Config.AddEndpoint(address, clusterName, port, endpoint.Region, endpoint.Weight)
+		e.HealthCheckPort = healthCheckPort
+		e.Tls = usesTls(endpoint, port)
+	}
+	return nil
+}
+
+// helper: split an endpoint address into host, port and url path
+// the url path is the base path the upstream serves the api on, it's empty for "/"
+func parseEndpoint(endpoint usercfg.Endpoint) (string, uint, string, error) {
+	// check if a port is specified in the url
+	// if there is one, then assign it to our port variable
+	// otherwise, use the endpoint's port, falling back on the scheme's default
+	var port uint
+
+	var addr string
+	if strings.Contains(endpoint.Address, "://") {
+		addr = endpoint.Address
+	} else {
+		addr = "https://" + endpoint.Address
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("error parsing url: %+v", err)
+	}
+	if _, ok := schemes[u.Scheme]; !ok {
+		return "", 0, "", fmt.Errorf("invalid schema: %s", u.Scheme)
+	}
+
+	portString := u.Port()
+	if portString == "" {
+		if endpoint.Port == 0 {
+			port = uint(schemes[u.Scheme])
+		} else {
+			port = endpoint.Port
+		}
+	} else {
+		p, _ := strconv.Atoi(portString)
+		port = uint(p)
+	}
+	return u.Hostname(), port, strings.TrimRight(u.Path, "/"), nil
+}
+
+// helper: the base path shared by all of a backend's endpoints
+// envoy rewrites paths per route, so endpoints of the same backend (splits included) can't disagree on it
+func backendBasePath(backend usercfg.Backend) (string, error) {
+	endpoints := append([]usercfg.Endpoint(nil), backend.Server.Endpoints...)
+	for _, split := range backend.Splits {
+		endpoints = append(endpoints, split.Server.Endpoints...)
+	}
+
+	var basePath string
+	for i, endpoint := range endpoints {
+		_, _, path, err := parseEndpoint(endpoint)
+		if err != nil {
+			return "", err
+		}
+		if i != 0 && path != basePath {
+			return "", fmt.Errorf("endpoints of a backend must share the same base path, got \"%s\" and \"%s\"", basePath, path)
+		}
+		basePath = path
+	}
+	return basePath, nil
+}
+
+// read the header changes made on each listener from a file
+func ParseListenerHeaders(filename string) (map[string]univcfg.HeaderRules, error) {
+	userHeaders, err := usercfg.ParseListenerHeaders(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(map[string]univcfg.HeaderRules)
+	for name, headers := range userHeaders {
+		if _, ok := univcfg.ZoneMasks[name]; !ok {
+			return nil, fmt.Errorf("%s: invalid listener name: %s", filename, name)
+		}
+		rules[name], err = convertHeaderRules(headers, usercfg.Headers{})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %+v", filename, name, err)
+		}
+	}
+	return rules, nil
+}
+
 // helper: rename cluster to provide information on which listeners have access
 func getClusterName(bag usercfg.Bag, backend usercfg.Backend) (string, error) {
-	var newName string
-
 	var name string
 	// if a path is given, then we want to make it our new cluster id
 	if backend.Match.Path.Pattern == "" {
@@ -224,121 +500,125 @@ func getClusterName(bag usercfg.Bag, backend usercfg.Backend) (string, error) {
 		name = strings.Replace(backend.Match.Path.Pattern, "/", "-", -1)[1:]
 	}
 
-	zone_mask := 0
-	if len(bag.Availability) == 0 {
-		zone_mask |= 3
+	bagMask, err := bagZones(bag)
+	if err != nil {
+		return "", err
 	}
 
-	for _, zone := range bag.Availability {
-		switch zone {
-		case "internal":
-			zone_mask |= 1
-		case "external":
-			zone_mask |= 2
-		case "gcp-external":
-			// pass
-		default:
-			return "", fmt.Errorf("invalid availability: %s", zone)
+	// backends default to every zone the bag is in
+	var backendMask uint8
+	if len(backend.Availability) == 0 {
+		backendMask = univcfg.ALL
+	}
+	for _, zone := range backend.Availability {
+		mask, ok := univcfg.ZoneMasks[zone]
+		if !ok {
+			return "", fmt.Errorf("invalid element in backend availability array")
 		}
+		backendMask |= mask
 	}
 
-	var aBag string
-	switch zone_mask {
-	case 0:
-		// it is legal for APIs to be gcp-external only
-		// we do not yet handle that case at higher calling functions
-		return "", fmt.Errorf("found gcp-external only api: %s", bag.Id)
-	case 1:
-		aBag = "in"
-	case 2:
-		aBag = "ex"
-	case 3:
-		aBag = "ie"
-	default:
-		return "", fmt.Errorf("unexpected availability bitmask: %d", zone_mask)
+	// backend can only be reached in zones the bag is also in
+	suffix := univcfg.Suffix(bagMask & backendMask)
+	if suffix == "" {
+		return "", fmt.Errorf("bag and backend have conflicting availabilities")
 	}
 
-	var aBack string
-	// add extension for the availability of the backend
-	switch len(backend.Availability) {
-	case 0:
-		aBack = "ie"
-	case 1:
-		if backend.Availability[0] == "internal" || backend.Availability[0] == "external" {
-			aBack = backend.Availability[0][:2]
+	// backends sharing a path but matching on more than that need their own cluster
+	if key := matchKey(backend.Match); key != "" {
+		if name == "" {
+			name = key
 		} else {
-			return "", fmt.Errorf("invalid element in backend availability array")
+			name = name + "-" + key
 		}
-	case 2:
-		if (backend.Availability[0] == "internal" || backend.Availability[0] == "external") &&
-			(backend.Availability[1] == "internal" || backend.Availability[1] == "external") {
-			aBack = "ie"
-		} else {
-			return "", fmt.Errorf("invalid element in backend availability array")
+	}
+
+	if name == "" {
+		return suffix, nil
+	}
+	return name + "-" + suffix, nil
+}
+
+// helper: short, stable key for the non path parts of a match, empty if it only matches on path
+func matchKey(match usercfg.Match) string {
+	if len(match.Headers) == 0 && len(match.Methods) == 0 && len(match.QueryParams) == 0 {
+		return ""
+	}
+	conditions, _ := json.Marshal([]interface{}{match.Headers, match.Methods, match.QueryParams})
+	hash := fnv.New32a()
+	hash.Write(conditions)
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
+
+// helper: get the set of zones a bag is available in, defaults to internal and external
+func bagZones(bag usercfg.Bag) (uint8, error) {
+	if len(bag.Availability) == 0 {
+		return univcfg.BOTH, nil
+	}
+
+	var zoneMask uint8
+	for _, zone := range bag.Availability {
+		mask, ok := univcfg.ZoneMasks[zone]
+		if !ok {
+			return 0, fmt.Errorf("invalid availability: %s", zone)
 		}
-	default:
-		return "", fmt.Errorf("invalid element in backend availability array")
+		zoneMask |= mask
 	}
+	return zoneMask, nil
+}
 
-	// compare the two extensions to create the actual extension for the cluster
-	switch aBag == aBack {
-	case true:
-		if name == "" {
-			newName = aBack
-		} else {
-			newName = name + "-" + aBack
+// helper: check if a route with the same path, available in fewer zones, already covers the zone
+func (bp *BagParser) moreSpecificRoute(name string, zone uint8) bool {
+	route := bp.Config.Routes[name]
+	base := name[:len(name)-2]
+	for _, other := range bp.Config.Routes {
+		if other == route || other.Availability&zone == 0 || other.ClusterName[:len(other.ClusterName)-2] != base {
+			continue
 		}
-	case false:
-		if aBag == "ie" {
-			if name == "" {
-				newName = aBack
-			} else {
-				newName = name + "-" + aBack
-			}
-		} else if aBack == "ie" {
-			if name == "" {
-				newName = aBag
-			} else {
-				newName = name + "-" + aBag
-			}
-		} else {
-			return "", fmt.Errorf("bag and backend have conflicting availabilities")
+		// routes available in the same number of zones are tie broken by name
+		otherBits, routeBits := bits.OnesCount8(other.Availability), bits.OnesCount8(route.Availability)
+		if otherBits < routeBits || (otherBits == routeBits && other.ClusterName < route.ClusterName) {
+			return true
 		}
 	}
-
-	return newName, nil
+	return false
 }
 
-func convertHealthCheck(userHealthCheck usercfg.HealthCheck) *univcfg.HealthCheck {
+func convertHealthCheck(userHealthCheck usercfg.HealthCheck) (*univcfg.HealthCheck, error) {
 	if reflect.DeepEqual(userHealthCheck, usercfg.HealthCheck{
-		Fall:     0,
-		Host:     "",
-		Interval: "",
-		Method:   "",
-		Path:     "",
-		Port:     0,
-		Rise:     0,
-		Type:     "",
-		Version:  "",
+		ExpectedStatus: nil,
+		Fall:           0,
+		Host:           "",
+		Interval:       "",
+		Method:         "",
+		Path:           "",
+		Port:           0,
+		Rise:           0,
+		Timeout:        "",
+		Type:           "",
+		Version:        "",
 	}) {
-		return nil
+		return nil, nil
 	}
 
-	nums := regexp.MustCompile("[0-9]+").FindAllString(userHealthCheck.Interval, -1)
-	var interval int
-	if nums == nil {
-		interval = 5
-	} else {
-		interval, _ = strconv.Atoi(nums[0])
+	interval, err := parseDuration(userHealthCheck.Interval, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check interval: %+v", err)
+	}
+	timeout, err := parseDuration(userHealthCheck.Timeout, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check timeout: %+v", err)
 	}
 
 	univHealthCheck := &univcfg.HealthCheck{
 		Healthy:   userHealthCheck.Rise,
 		Host:      userHealthCheck.Host,
-		Interval:  uint(interval),
+		Interval:  interval,
+		Method:    strings.ToUpper(userHealthCheck.Method),
 		Path:      userHealthCheck.Path,
 		Port:      userHealthCheck.Port,
-		Type:      userHealthCheck.Type,
+		Timeout:   timeout,
+		Type:      strings.ToLower(userHealthCheck.Type),
 		Unhealthy: userHealthCheck.Fall,
 	}
 
@@ -354,6 +634,646 @@ func convertHealthCheck(userHealthCheck usercfg.HealthCheck) *univcfg.HealthChec
 	if univHealthCheck.Unhealthy == 0 {
 		univHealthCheck.Unhealthy = 3
 	}
+	if univHealthCheck.Type != "tcp" && univHealthCheck.Type != "http" {
+		return nil, fmt.Errorf("invalid health check type: %s", userHealthCheck.Type)
+	}
+
+	// the rest only matters for http health checks
+	if univHealthCheck.Type == "tcp" {
+		return univHealthCheck, nil
+	}
+
+	if univHealthCheck.Method == "" {
+		univHealthCheck.Method = "GET"
+	}
+	if _, ok := methods[univHealthCheck.Method]; !ok {
+		return nil, fmt.Errorf("invalid health check method: %s", userHealthCheck.Method)
+	}
+
+	switch strings.ToUpper(userHealthCheck.Version) {
+	case "", "HTTP/1.0", "HTTP/1.1":
+		univHealthCheck.Version = "HTTP/1.1"
+	case "HTTP/2", "HTTP/2.0":
+		univHealthCheck.Version = "HTTP/2"
+	default:
+		return nil, fmt.Errorf("invalid health check version: %s", userHealthCheck.Version)
+	}
+
+	// haproxy treats any 2xx or 3xx response as healthy unless told otherwise
+	if len(userHealthCheck.ExpectedStatus) == 0 {
+		univHealthCheck.ExpectedStatuses = []univcfg.StatusRange{{Start: 200, End: 399}}
+	}
+	for _, status := range userHealthCheck.ExpectedStatus {
+		statusRange, err := parseStatusRange(status)
+		if err != nil {
+			return nil, err
+		}
+		univHealthCheck.ExpectedStatuses = append(univHealthCheck.ExpectedStatuses, statusRange)
+	}
+
+	return univHealthCheck, nil
+}
+
+// helper: parse a haproxy style duration (e.g. "500ms", "2m", "1h")
+// numbers without a unit are in seconds, existing health check intervals were written that way
+func parseDuration(duration string, defaultDuration time.Duration) (time.Duration, error) {
+	if duration == "" {
+		return defaultDuration, nil
+	}
+
+	match := durationFormat.FindStringSubmatch(strings.TrimSpace(duration))
+	if match == nil {
+		return 0, fmt.Errorf("can't parse duration: %s", duration)
+	}
+	value, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, fmt.Errorf("can't parse duration: %s", duration)
+	}
+	if value == 0 {
+		return 0, fmt.Errorf("duration must be greater than 0: %s", duration)
+	}
+
+	return time.Duration(value) * durationUnits[match[2]], nil
+}
+
+// helper: parse a status code ("200") or an inclusive range of status codes ("200-299")
+func parseStatusRange(status string) (univcfg.StatusRange, error) {
+	bounds := strings.SplitN(status, "-", 2)
+	start, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return univcfg.StatusRange{}, fmt.Errorf("invalid health check status: %s", status)
+	}
+	end := start
+	if len(bounds) == 2 {
+		end, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return univcfg.StatusRange{}, fmt.Errorf("invalid health check status: %s", status)
+		}
+	}
+	if start < 100 || end > 599 || start > end {
+		return univcfg.StatusRange{}, fmt.Errorf("invalid health check status: %s", status)
+	}
+
+	return univcfg.StatusRange{Start: uint(start), End: uint(end)}, nil
+}
+
+// helper: turn the header, query parameter and method parts of a match into their universal counterparts
+func convertMatchConditions(match usercfg.Match) ([]univcfg.HeaderMatch, []univcfg.QueryParamMatch, []string, error) {
+	var headers []univcfg.HeaderMatch
+	var queryParams []univcfg.QueryParamMatch
+	var routeMethods []string
+
+	for _, header := range match.Headers {
+		matchType, err := checkValueMatch("header", header.Name, header.Type, header.Value)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		headers = append(headers, univcfg.HeaderMatch{
+			Invert: header.Invert,
+			Name:   header.Name,
+			Type:   matchType,
+			Value:  header.Value,
+		})
+	}
+	for _, param := range match.QueryParams {
+		matchType, err := checkValueMatch("query parameter", param.Name, param.Type, param.Value)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		queryParams = append(queryParams, univcfg.QueryParamMatch{
+			Name:  param.Name,
+			Type:  matchType,
+			Value: param.Value,
+		})
+	}
+	for _, method := range match.Methods {
+		method = strings.ToUpper(method)
+		if _, ok := methods[method]; !ok && method != "CONNECT" {
+			return nil, nil, nil, fmt.Errorf("invalid match method: %s", method)
+		}
+		routeMethods = append(routeMethods, method)
+	}
+
+	return headers, queryParams, routeMethods, nil
+}
+
+// helper: make sure a header or query parameter match makes sense, returns the match type (defaults to exact)
+func checkValueMatch(kind string, name string, matchType string, value string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("%s match is missing a name", kind)
+	}
+	switch matchType {
+	case "":
+		matchType = "exact"
+	case "exact", "prefix", "suffix", "contains", "regex", "present":
+	default:
+		return "", fmt.Errorf("invalid %s match type for %s: %s", kind, name, matchType)
+	}
+	if matchType == "present" {
+		return matchType, nil
+	}
+	if value == "" && matchType != "exact" {
+		return "", fmt.Errorf("%s match for %s is missing a value", kind, name)
+	}
+	if matchType == "regex" {
+		if _, err := regexp.Compile(value); err != nil {
+			return "", fmt.Errorf("invalid %s regex for %s: %+v", kind, name, err)
+		}
+	}
+	return matchType, nil
+}
+
+// helper: work out how a route's path gets rewritten before it's sent upstream
+// the endpoints' base path goes in front of whatever the backend rewrites the path to
+func convertRewrite(rewrite usercfg.Rewrite, pathType string, basePath string) (string, *univcfg.RegexRewrite, error) {
+	if rewrite.Prefix != "" && rewrite.Regex.Pattern != "" {
+		return "", nil, fmt.Errorf("rewrite can have a prefix or a regex, not both")
+	}
+
+	if rewrite.Regex.Pattern != "" {
+		if _, err := regexp.Compile(rewrite.Regex.Pattern); err != nil {
+			return "", nil, fmt.Errorf("invalid rewrite regex: %+v", err)
+		}
+		// envoy substitutes every match, the base path only ends up in front once if the pattern is anchored
+		if basePath != "" && !strings.HasPrefix(rewrite.Regex.Pattern, "^") {
+			return "", nil, fmt.Errorf("rewrite regex has to start with ^ when the endpoints have a base path (%s)", basePath)
+		}
+		return "", &univcfg.RegexRewrite{
+			Pattern:      rewrite.Regex.Pattern,
+			Substitution: basePath + rewrite.Regex.Substitution,
+		}, nil
+	}
+
+	if rewrite.Prefix == "" {
+		if basePath == "" {
+			return "", nil, nil
+		}
+		// no rewrite, so the full public path goes upstream behind the base path
+		return "", &univcfg.RegexRewrite{
+			Pattern:      "^(.*)$",
+			Substitution: basePath + "\\1",
+		}, nil
+	}
+	// envoy has no prefix to swap out when the route matches on a regex
+	if pathType == "regex" {
+		return "", nil, fmt.Errorf("regex paths can only be rewritten with a regex rewrite")
+	}
+	prefix := strings.TrimRight(basePath+rewrite.Prefix, "/")
+	if prefix == "" {
+		prefix = "/"
+	}
+	return prefix, nil, nil
+}
+
+// helper: work out how a backend's traffic is shared between its servers and splits, nil if it isn't split
+// the backend's own servers get whatever weight the splits leave over
+func convertSplits(clusterName string, backend usercfg.Backend) ([]univcfg.WeightedCluster, error) {
+	if len(backend.Splits) == 0 {
+		return nil, nil
+	}
+
+	var total uint
+	var splits []univcfg.WeightedCluster
+	names := make(map[string]bool)
+	for _, split := range backend.Splits {
+		if names[split.Name] {
+			return nil, fmt.Errorf("duplicate split name: %s", split.Name)
+		}
+		names[split.Name] = true
+		total += split.Weight
+		if split.Weight != 0 {
+			splits = append(splits, univcfg.WeightedCluster{
+				Name:   univcfg.SplitName(clusterName, split.Name),
+				Weight: split.Weight,
+			})
+		}
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("split weights add up to %d%%, can't be more than 100%%", total)
+	}
+
+	if total < 100 {
+		if len(backend.Server.Endpoints) == 0 {
+			return nil, fmt.Errorf("split weights add up to %d%%, must be 100%% when the backend has no servers", total)
+		}
+		splits = append([]univcfg.WeightedCluster{{Name: clusterName, Weight: 100 - total}}, splits...)
+	}
+	return splits, nil
+}
+
+// helper: combine a bag's and a backend's header changes, the backend wins if they set the same header
+func convertHeaderRules(bagHeaders usercfg.Headers, backendHeaders usercfg.Headers) (univcfg.HeaderRules, error) {
+	var rules univcfg.HeaderRules
+	var err error
+	rules.Request, err = convertHeaderActions(bagHeaders.Request, backendHeaders.Request)
+	if err != nil {
+		return rules, fmt.Errorf("request headers: %+v", err)
+	}
+	rules.Response, err = convertHeaderActions(bagHeaders.Response, backendHeaders.Response)
+	if err != nil {
+		return rules, fmt.Errorf("response headers: %+v", err)
+	}
+	return rules, nil
+}
+
+// helper: merge header actions into sorted lists, so the same databag always makes the same config
+func convertHeaderActions(bagActions usercfg.HeaderActions, backendActions usercfg.HeaderActions) (univcfg.HeaderActions, error) {
+	var actions univcfg.HeaderActions
+
+	// added values pile up, so keep the bag's and the backend's
+	for _, add := range []map[string]string{bagActions.Add, backendActions.Add} {
+		values, err := headerValues(add)
+		if err != nil {
+			return actions, err
+		}
+		actions.Add = append(actions.Add, values...)
+	}
+
+	set := make(map[string]string)
+	for name, value := range bagActions.Set {
+		set[strings.ToLower(name)] = value
+	}
+	for name, value := range backendActions.Set {
+		set[strings.ToLower(name)] = value
+	}
+	values, err := headerValues(set)
+	if err != nil {
+		return actions, err
+	}
+	actions.Set = values
+
+	removed := make(map[string]bool)
+	for _, name := range append(append([]string(nil), bagActions.Remove...), backendActions.Remove...) {
+		name = strings.ToLower(name)
+		if err := checkHeaderName(name); err != nil {
+			return actions, err
+		}
+		if !removed[name] {
+			removed[name] = true
+			actions.Remove = append(actions.Remove, name)
+		}
+	}
+	sort.Strings(actions.Remove)
+
+	return actions, nil
+}
+
+// helper: turn a header name -> value map into a list sorted by name
+func headerValues(headers map[string]string) ([]univcfg.HeaderValue, error) {
+	var values []univcfg.HeaderValue
+	for name, value := range headers {
+		if err := checkHeaderName(name); err != nil {
+			return nil, err
+		}
+		values = append(values, univcfg.HeaderValue{Name: name, Value: value})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values, nil
+}
+
+// helper: envoy won't touch pseudo headers (":path", ":authority", ...) or the host header
+func checkHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("header name can't be empty")
+	}
+	if strings.HasPrefix(name, ":") || strings.ToLower(name) == "host" {
+		return fmt.Errorf("can't change header: %s", name)
+	}
+	return nil
+}
+
+// helper: turn a bag's or backend's cors settings into a universal cors policy, nil if cors is off
+// a backend with its own allowed origins uses its own settings instead of the bag's
+func convertCors(bagCors usercfg.Cors, backendCors usercfg.Cors) (*univcfg.CorsPolicy, error) {
+	userCors := bagCors
+	if len(backendCors.AllowOrigins) != 0 {
+		userCors = backendCors
+	}
+	if len(userCors.AllowOrigins) == 0 {
+		if hasCorsSettings(bagCors) || hasCorsSettings(backendCors) {
+			return nil, fmt.Errorf("cors settings need at least one allowed origin")
+		}
+		return nil, nil
+	}
+
+	cors := &univcfg.CorsPolicy{
+		AllowCredentials: userCors.AllowCredentials,
+		AllowHeaders:     userCors.AllowHeaders,
+		ExposeHeaders:    userCors.ExposeHeaders,
+	}
+	for _, origin := range userCors.AllowOrigins {
+		switch origin.Type {
+		case "", "exact":
+			origin.Type = "exact"
+		case "regex":
+			if _, err := regexp.Compile(origin.Value); err != nil {
+				return nil, fmt.Errorf("invalid cors origin regex: %+v", err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid cors origin type: %s", origin.Type)
+		}
+		cors.AllowOrigins = append(cors.AllowOrigins, univcfg.CorsOrigin{Type: origin.Type, Value: origin.Value})
+	}
+	for _, method := range userCors.AllowMethods {
+		method = strings.ToUpper(method)
+		if !methods[method] {
+			return nil, fmt.Errorf("invalid cors method: %s", method)
+		}
+		cors.AllowMethods = append(cors.AllowMethods, method)
+	}
+
+	maxAge, err := parseDuration(userCors.MaxAge, 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxAge != 0 && maxAge < time.Second {
+		return nil, fmt.Errorf("cors max age must be at least 1s: %s", userCors.MaxAge)
+	}
+	cors.MaxAge = maxAge
+
+	return cors, nil
+}
+
+// helper: check if any cors setting other than the allowed origins is set
+func hasCorsSettings(cors usercfg.Cors) bool {
+	return cors.AllowCredentials || len(cors.AllowHeaders) != 0 || len(cors.AllowMethods) != 0 ||
+		len(cors.ExposeHeaders) != 0 || cors.MaxAge != ""
+}
+
+// helper: work out if a backend answers requests itself instead of sending them to its servers
+// a backend with nowhere to send requests gets a 503, so its route never points at a missing cluster
+func convertResponse(bag usercfg.Bag, backend usercfg.Backend) (*univcfg.DirectResponse, *univcfg.Redirect, error) {
+	hasDirect := backend.Direct.Status != 0 || backend.Direct.Body != ""
+	hasRedirect := backend.Redirect != (usercfg.Redirect{})
+	if (hasDirect && hasRedirect) || (hasDirect && backend.Maintenance) || (hasRedirect && backend.Maintenance) {
+		return nil, nil, fmt.Errorf("backend can only have one of direct_response, redirect and maintenance")
+	}
+
+	switch {
+	case backend.Maintenance:
+		message := backend.Message
+		if message == "" {
+			message = bag.Id + " is down for maintenance"
+		}
+		return &univcfg.DirectResponse{Status: 503, Body: message}, nil, nil
+	case hasDirect:
+		if backend.Direct.Status < 200 || backend.Direct.Status > 599 {
+			return nil, nil, fmt.Errorf("invalid direct response status: %d", backend.Direct.Status)
+		}
+		return &univcfg.DirectResponse{Status: backend.Direct.Status, Body: backend.Direct.Body}, nil, nil
+	case hasRedirect:
+		redirect, err := convertRedirect(backend.Redirect)
+		return nil, redirect, err
+	case len(backend.Server.Endpoints) == 0 && len(backend.Splits) == 0:
+		return &univcfg.DirectResponse{Status: 503, Body: bag.Id + " has no servers"}, nil, nil
+	}
+	return nil, nil, nil
+}
+
+// helper: turn user redirect into universal redirect
+func convertRedirect(userRedirect usercfg.Redirect) (*univcfg.Redirect, error) {
+	redirect := &univcfg.Redirect{
+		Path:   userRedirect.Path,
+		Prefix: userRedirect.Prefix,
+		Status: userRedirect.Status,
+	}
+	if redirect.Path != "" && redirect.Prefix != "" {
+		return nil, fmt.Errorf("redirect can have a path or a prefix, not both")
+	}
+
+	switch userRedirect.Scheme {
+	case "", "http", "https":
+		redirect.Scheme = userRedirect.Scheme
+	default:
+		return nil, fmt.Errorf("invalid redirect scheme: %s", userRedirect.Scheme)
+	}
+
+	switch redirect.Status {
+	case 0:
+		redirect.Status = 301
+	case 301, 302, 303, 307, 308:
+	default:
+		return nil, fmt.Errorf("invalid redirect status: %d", redirect.Status)
+	}
+
+	// the host can come with a port ("cars.target.com:8443")
+	if userRedirect.Host != "" {
+		u, err := url.Parse("//" + userRedirect.Host)
+		if err != nil || u.Hostname() == "" || u.Path != "" {
+			return nil, fmt.Errorf("invalid redirect host: %s", userRedirect.Host)
+		}
+		redirect.Host = u.Hostname()
+		if u.Port() != "" {
+			port, _ := strconv.Atoi(u.Port())
+			redirect.Port = uint(port)
+		}
+	}
+
+	return redirect, nil
+}
+
+// helper: check how a backend's hostname endpoints get resolved, defaults to strict dns
+// logical dns only ever connects to one address, so each cluster can only have one endpoint
+func convertDns(backend usercfg.Backend) (string, error) {
+	switch backend.Dns {
+	case "", "strict":
+		return "strict", nil
+	case "logical":
+		if len(backend.Server.Endpoints) > 1 {
+			return "", fmt.Errorf("logical dns backends can only have one endpoint per server group")
+		}
+		for _, split := range backend.Splits {
+			if len(split.Server.Endpoints) > 1 {
+				return "", fmt.Errorf("logical dns backends can only have one endpoint per server group")
+			}
+		}
+		return "logical", nil
+	default:
+		return "", fmt.Errorf("invalid dns type: %s", backend.Dns)
+	}
+}
+
+// helper: check if an endpoint is called over https
+// the endpoint's scheme decides, endpoints without one only use https on port 443
+func usesTls(endpoint usercfg.Endpoint, port uint) bool {
+	scheme, _, found := strings.Cut(endpoint.Address, "://")
+	if found {
+		return scheme == "https"
+	}
+	return port == 443
+}
+
+// helper: work out a server group's upstream tls settings, nil if none of its endpoints use https
+func convertTls(userTls usercfg.Tls, endpoints []usercfg.Endpoint, defaults univcfg.UpstreamTls) (*univcfg.UpstreamTls, error) {
+	hosts := make(map[string]bool)
+	hasIp := false
+	for _, endpoint := range endpoints {
+		host, port, _, err := parseEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if usesTls(endpoint, port) {
+			hosts[host] = true
+			hasIp = hasIp || net.ParseIP(host) != nil
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+
+	upstreamTls := &univcfg.UpstreamTls{
+		Sni:             userTls.Sni,
+		CaFile:          userTls.Ca,
+		SubjectAltNames: userTls.VerifySan,
+		CertFile:        userTls.Cert,
+		KeyFile:         userTls.Key,
+	}
+	if userTls.Insecure {
+		if upstreamTls.CaFile != "" || len(upstreamTls.SubjectAltNames) > 0 {
+			return nil, fmt.Errorf("insecure tls can't verify against a ca or subject alt names")
+		}
+	} else if upstreamTls.CaFile == "" {
+		upstreamTls.CaFile = defaults.CaFile
+	}
+	if upstreamTls.CertFile == "" && upstreamTls.KeyFile == "" {
+		upstreamTls.CertFile, upstreamTls.KeyFile = defaults.CertFile, defaults.KeyFile
+	}
+	if (upstreamTls.CertFile == "") != (upstreamTls.KeyFile == "") {
+		return nil, fmt.Errorf("tls client certificate and key have to be set together")
+	}
+	if len(upstreamTls.SubjectAltNames) > 0 && upstreamTls.CaFile == "" {
+		return nil, fmt.Errorf("verifying subject alt names needs a ca")
+	}
+	if !userTls.Insecure && upstreamTls.CaFile == "" {
+		return nil, fmt.Errorf("https endpoints need a ca to be verified against (tls ca or -upstream-ca), or \"insecure\": true")
+	}
+
+	// without a name of its own the group sends its https endpoints' hostname
+	if upstreamTls.Sni == "" && len(hosts) == 1 {
+		for host := range hosts {
+			if !hasIp {
+				upstreamTls.Sni = host
+			}
+		}
+	} else if upstreamTls.Sni == "" && !hasIp {
+		// envoy picks the name per request from the host it's sending to, which an ip address doesn't have
+		upstreamTls.AutoSni = true
+	}
+	// an ip address has no name to send or check the certificate against, so the bag has to give one
+	if !userTls.Insecure && upstreamTls.Sni == "" && !upstreamTls.AutoSni && len(upstreamTls.SubjectAltNames) == 0 {
+		return nil, fmt.Errorf("https ip endpoints need a tls sni or verify_san to check their certificate against, or \"insecure\": true")
+	}
+	// a certificate from a trusted ca isn't enough, it has to be for the name that was asked for
+	if upstreamTls.CaFile != "" && len(upstreamTls.SubjectAltNames) == 0 && upstreamTls.Sni != "" {
+		upstreamTls.SubjectAltNames = []string{upstreamTls.Sni}
+	}
+	return upstreamTls, nil
+}
+
+// helper: check if any upstream tls settings are given
+func hasTlsSettings(userTls usercfg.Tls) bool {
+	return userTls.Ca != "" || userTls.Cert != "" || userTls.Key != "" || userTls.Sni != "" || len(userTls.VerifySan) > 0 || userTls.Insecure
+}
+
+// helper: turn user circuit breaker into universal circuit breaker, nil if no limits are set
+func convertBreaker(userBreaker usercfg.Breaker) *univcfg.CircuitBreaker {
+	if userBreaker == (usercfg.Breaker{}) {
+		return nil
+	}
+	return &univcfg.CircuitBreaker{
+		MaxConnections:     userBreaker.MaxConnections,
+		MaxPendingRequests: userBreaker.MaxPendingRequests,
+		MaxRequests:        userBreaker.MaxRequests,
+		MaxRetries:         userBreaker.MaxRetries,
+	}
+}
+
+// helper: turn user outlier detection into universal outlier detection, nil if it's off
+func convertOutlier(userOutlier usercfg.Outlier) (*univcfg.OutlierDetection, error) {
+	if userOutlier == (usercfg.Outlier{}) {
+		return nil, nil
+	}
+	if userOutlier.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("max ejection percent can't be more than 100: %d", userOutlier.MaxEjectionPercent)
+	}
+	ejectionTime, err := parseDuration(userOutlier.EjectionTime, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &univcfg.OutlierDetection{
+		Consecutive5xx:     userOutlier.Consecutive5xx,
+		EjectionTime:       ejectionTime,
+		MaxEjectionPercent: userOutlier.MaxEjectionPercent,
+	}, nil
+}
+
+// helper: turn a haproxy balance algorithm into a load balancing policy, plus what to hash on for hash based ones
+func convertBalance(balance string) (string, *univcfg.HashPolicy, error) {
+	if lbPolicy, ok := policy[balance]; ok {
+		return lbPolicy, nil, nil
+	}
+
+	match := balanceFormat.FindStringSubmatch(balance)
+	if match == nil {
+		return "", nil, fmt.Errorf("invalid balance algorithm: %s", balance)
+	}
+	hashType, ok := hashPolicy[match[1]]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid balance algorithm: %s", balance)
+	}
+	// "source" and "uri" already know what to hash, the rest need to be told
+	needsName := hashType != "source_ip" && hashType != "path"
+	if needsName != (match[2] != "") {
+		return "", nil, fmt.Errorf("invalid balance algorithm: %s", balance)
+	}
+	return "ring_hash", &univcfg.HashPolicy{Type: hashType, Name: match[2]}, nil
+}
+
+// helper: turn user retry settings into a universal retry policy, nil if retrying is off
+func convertRetry(userRetry usercfg.Retry) (*univcfg.RetryPolicy, error) {
+	if userRetry.Count == 0 {
+		if len(userRetry.On) != 0 || userRetry.PerTryTimeout != "" {
+			return nil, fmt.Errorf("retry settings need a retry count")
+		}
+		return nil, nil
+	}
+
+	perTryTimeout, err := parseDuration(userRetry.PerTryTimeout, 0)
+	if err != nil {
+		return nil, err
+	}
+	on := userRetry.On
+	// only retry requests that never made it to the backend unless told otherwise, those are always safe to send again
+	if len(on) == 0 {
+		on = []string{"connect-failure", "refused-stream"}
+	}
+	for _, condition := range on {
+		if !retryOn[condition] {
+			return nil, fmt.Errorf("invalid retry condition: %s", condition)
+		}
+	}
+
+	return &univcfg.RetryPolicy{
+		Count:         userRetry.Count,
+		On:            on,
+		PerTryTimeout: perTryTimeout,
+	}, nil
+}
+
+// helper: turn user rate limit into universal rate limit, nil if no limit is set
+func convertRateLimit(userRateLimit usercfg.RateLimit) (*univcfg.RateLimit, error) {
+	if userRateLimit.Count == 0 {
+		return nil, nil
+	}
+
+	switch userRateLimit.Field {
+	case "", "client-ip", "api-key":
+	default:
+		return nil, fmt.Errorf("invalid rate limit field: %s", userRateLimit.Field)
+	}
 
-	return univHealthCheck
+	return &univcfg.RateLimit{
+		Count: userRateLimit.Count,
+		Field: userRateLimit.Field,
+	}, nil
 }
@@ -1,7 +1,10 @@
 package parser
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	univcfg "github.com/fmgornick/dynamic-proxy/app/config/universal"
 	usercfg "github.com/fmgornick/dynamic-proxy/app/config/user"
@@ -84,6 +87,7 @@ var lconfig univcfg.ListenerInfo = univcfg.ListenerInfo{
 	ExternalAddress: "external.address",
 	InternalPort:    1111,
 	ExternalPort:    2222,
+	UpstreamTls:     univcfg.UpstreamTls{CaFile: "ca.crt"},
 }
 var parser BagParser = BagParser{
 	Bags:         []usercfg.Bag{bagWithoutId, bagWithId},
@@ -107,7 +111,7 @@ func TestParse(t *testing.T) {
 
 	assert.Equal(t, uint(100), config.Clusters["in"].HealthCheck.Healthy, "ex cluster should be external")
 	assert.Equal(t, "google", config.Clusters["in"].HealthCheck.Host, "ex cluster should be external")
-	assert.Equal(t, uint(5), config.Clusters["in"].HealthCheck.Interval, "ex cluster should be external")
+	assert.Equal(t, 5*time.Second, config.Clusters["in"].HealthCheck.Interval, "ex cluster should be external")
 	assert.Equal(t, "/path/name", config.Clusters["in"].HealthCheck.Path, "ex cluster should be external")
 	assert.Equal(t, uint(1234), config.Clusters["in"].HealthCheck.Port, "ex cluster should be external")
 	assert.Equal(t, "http", config.Clusters["in"].HealthCheck.Type, "ex cluster should be external")
@@ -359,3 +363,731 @@ func TestGetClusterName(t *testing.T) {
 	assert.Equal(t, "", res16, "nothing returned because it should produce an error")
 	assert.EqualError(t, err16, "invalid element in backend availability array", "should fail because array has invalid value")
 }
+
+func TestConvertRateLimit(t *testing.T) {
+	rl1, err1 := convertRateLimit(usercfg.RateLimit{})
+	rl2, err2 := convertRateLimit(usercfg.RateLimit{Count: 10, Field: "client-ip"})
+	rl3, err3 := convertRateLimit(usercfg.RateLimit{Count: 15})
+	rl4, err4 := convertRateLimit(usercfg.RateLimit{Count: 5, Field: "cookie"})
+
+	assert.Nil(t, rl1, "no rate limit should be set if count is 0")
+	assert.NoError(t, err1, "should not produce an error")
+	assert.Equal(t, &univcfg.RateLimit{Count: 10, Field: "client-ip"}, rl2, "rate limit should carry count and field")
+	assert.NoError(t, err2, "should not produce an error")
+	assert.Equal(t, &univcfg.RateLimit{Count: 15, Field: ""}, rl3, "rate limit without field should limit whole route")
+	assert.NoError(t, err3, "should not produce an error")
+	assert.Nil(t, rl4, "nothing returned because it should produce an error")
+	assert.EqualError(t, err4, "invalid rate limit field: cookie", "should fail because field is unknown")
+}
+
+func TestAddRoutesRateLimitService(t *testing.T) {
+	bag := usercfg.Bag{
+		Availability: []string{"internal"},
+		Backends: []usercfg.Backend{{
+			RateLimit: usercfg.RateLimit{Count: 10, Field: "client-ip"},
+			Server: usercfg.Server{
+				Endpoints: []usercfg.Endpoint{{
+					Address: "internal.endpoint.address",
+				}},
+			},
+		}},
+		Id: "bag-path",
+	}
+
+	_, err := Parse([]usercfg.Bag{bag}, lconfig)
+	assert.EqualError(t, err, "unable to add routes: client-ip rate limit on bag-path-in needs a rate limit service (-ratelimit-service)",
+		"per client limit can't be kept without the rate limit service")
+
+	info := lconfig
+	info.RateLimitService = "ratelimit.address:8081"
+	info.RateLimitCounts = []uint{5, 10}
+	config, err := Parse([]usercfg.Bag{bag}, info)
+	assert.NoError(t, err, "per client limit should be kept by the rate limit service")
+	assert.True(t, config.Listeners["internal"].RateLimits, "listener should know about the rate limit service")
+
+	// the service lets through anything it has no rule for
+	bag.Backends[0].RateLimit.Count = 7
+	_, err = Parse([]usercfg.Bag{bag}, info)
+	assert.EqualError(t, err, "unable to add routes: client-ip rate limit on bag-path-in has a count of 7, which the rate limit service has no rule for (-ratelimit-counts)",
+		"per client limit without a service rule should be rejected")
+
+	bag.Backends[0].RateLimit.Field = ""
+	_, err = Parse([]usercfg.Bag{bag}, lconfig)
+	assert.NoError(t, err, "whole route limit doesn't need the rate limit service")
+}
+
+func TestAddRoutesGroups(t *testing.T) {
+	p := BagParser{
+		Bags: []usercfg.Bag{{
+			Availability: []string{"internal"},
+			Backends: []usercfg.Backend{{
+				Server: usercfg.Server{
+					Endpoints: []usercfg.Endpoint{{
+						Address: "internal.endpoint.address",
+					}},
+				},
+			}},
+			Groups: []string{"CN=APP-API-Group"},
+			Id:     "bag-path",
+		}},
+		Config:       *univcfg.NewConfig(),
+		ListenerInfo: univcfg.ListenerInfo{GroupsHeader: "x-user-groups"},
+	}
+	p.AddListeners()
+	err := p.AddRoutes()
+	assert.NoError(t, err, "AddRoutes should not produce an error")
+
+	assert.Equal(t, []string{"CN=APP-API-Group"}, p.Config.Routes["bag-path-in"].Groups, "route should carry the bag's groups")
+	assert.Equal(t, "x-user-groups", p.Config.Listeners["internal"].GroupsHeader, "listener should carry the groups header")
+
+	// group checks that are turned off would leave the routes open to everyone
+	p.Config = *univcfg.NewConfig()
+	p.ListenerInfo.GroupsHeader = ""
+	p.AddListeners()
+	err = p.AddRoutes()
+	assert.EqualError(t, err, "bag bag-path has groups, but group checks are turned off (empty -groups-header)",
+		"groups without a groups header should be rejected")
+
+	p.Config = *univcfg.NewConfig()
+	p.ListenerInfo.GroupsHeader = "x-user-groups"
+	p.Bags[0].Groups = []string{"CN=APP-API-Group;CN=Other"}
+	p.AddListeners()
+	err = p.AddRoutes()
+	assert.EqualError(t, err, "group can't contain a semicolon: CN=APP-API-Group;CN=Other", "groups are separated by semicolons")
+}
+
+func TestGcpExternal(t *testing.T) {
+	gcpBag := usercfg.Bag{
+		Availability: []string{"gcp-external"},
+		Backends: []usercfg.Backend{{
+			Server: usercfg.Server{
+				Endpoints: []usercfg.Endpoint{{
+					Address: "gcp.endpoint.address",
+				}},
+			},
+		}},
+		Id: "gcp",
+	}
+	mixedBag := usercfg.Bag{
+		Availability: []string{"internal", "gcp-external"},
+		Backends: []usercfg.Backend{
+			{
+				Server: usercfg.Server{
+					Endpoints: []usercfg.Endpoint{{
+						Address: "mixed.endpoint.address",
+					}},
+				},
+			},
+			{
+				Availability: []string{"gcp-external"},
+				Server: usercfg.Server{
+					Endpoints: []usercfg.Endpoint{{
+						Address: "mixed.gcp.endpoint.address",
+					}},
+				},
+			},
+		},
+		Id: "mixed",
+	}
+
+	res1, err1 := getClusterName(gcpBag, gcpBag.Backends[0])
+	res2, err2 := getClusterName(mixedBag, mixedBag.Backends[0])
+	res3, err3 := getClusterName(mixedBag, mixedBag.Backends[1])
+	res4, err4 := getClusterName(gcpBag, backends[0])
+	assert.Equal(t, "gcp-gc", res1, "should have gcp-external extension")
+	assert.NoError(t, err1, "should not produce an error")
+	assert.Equal(t, "mixed-ig", res2, "should have internal + gcp-external extension")
+	assert.NoError(t, err2, "should not produce an error")
+	assert.Equal(t, "mixed-gc", res3, "should have gcp-external extension")
+	assert.NoError(t, err3, "should not produce an error")
+	assert.Equal(t, "", res4, "nothing returned because it should produce an error")
+	assert.EqualError(t, err4, "bag and backend have conflicting availabilities", "should fail because availabilities don't match")
+
+	gcpInfo := lconfig
+	gcpInfo.GcpAddress = "gcp.address"
+	gcpInfo.GcpPort = 3333
+	config, err := Parse([]usercfg.Bag{gcpBag, mixedBag}, gcpInfo)
+	assert.NoError(t, err, "Parse should not produce an error")
+	assert.Equal(t, uint(3333), config.Listeners["gcp-external"].Port, "listener port should match")
+	assert.Equal(t, uint8(univcfg.GCP_EXTERNAL), config.Routes["gcp-gc"].Availability, "route should be gcp-external")
+	assert.ElementsMatch(t, []string{"gcp-gc", "mixed-gc"}, config.Listeners["gcp-external"].Routes,
+		"gcp-external listener should prefer the more specific route")
+	assert.ElementsMatch(t, []string{"mixed-ig"}, config.Listeners["internal"].Routes, "internal listener should get mixed route")
+	assert.Empty(t, config.Listeners["external"].Routes, "external listener should have no routes")
+
+	config, err = Parse([]usercfg.Bag{gcpBag, mixedBag}, lconfig)
+	assert.NoError(t, err, "Parse should not produce an error")
+	assert.Nil(t, config.Listeners["gcp-external"], "gcp-external listener should be disabled")
+	assert.Nil(t, config.Routes["gcp-gc"], "gcp-external only bag should be skipped")
+	assert.NotNil(t, config.Routes["mixed-ig"], "bag with other zones should not be skipped")
+}
+
+func TestParseDuration(t *testing.T) {
+	d1, err1 := parseDuration("500ms", time.Second)
+	d2, err2 := parseDuration("2m", time.Second)
+	d3, err3 := parseDuration("2", time.Second)
+	d4, err4 := parseDuration("", time.Second)
+	_, err5 := parseDuration("5 seconds", time.Second)
+	_, err6 := parseDuration("0s", time.Second)
+
+	assert.Equal(t, 500*time.Millisecond, d1, "should parse milliseconds")
+	assert.NoError(t, err1, "should not produce an error")
+	assert.Equal(t, 2*time.Minute, d2, "should parse minutes")
+	assert.NoError(t, err2, "should not produce an error")
+	assert.Equal(t, 2*time.Second, d3, "numbers without a unit should be seconds")
+	assert.NoError(t, err3, "should not produce an error")
+	assert.Equal(t, time.Second, d4, "empty duration should use default")
+	assert.NoError(t, err4, "should not produce an error")
+	assert.EqualError(t, err5, "can't parse duration: 5 seconds", "should fail on unknown unit")
+	assert.EqualError(t, err6, "duration must be greater than 0: 0s", "should fail on zero duration")
+}
+
+func TestConvertHealthCheck(t *testing.T) {
+	hc1, err1 := convertHealthCheck(usercfg.HealthCheck{
+		ExpectedStatus: []string{"200-299", "404"},
+		Interval:       "2s",
+		Method:         "head",
+		Timeout:        "500ms",
+		Type:           "http",
+		Version:        "HTTP/2",
+	})
+	hc2, err2 := convertHealthCheck(usercfg.HealthCheck{Type: "http"})
+	_, err3 := convertHealthCheck(usercfg.HealthCheck{Type: "http", Method: "CONNECT"})
+	_, err4 := convertHealthCheck(usercfg.HealthCheck{Type: "http", Version: "HTTP/3"})
+	_, err5 := convertHealthCheck(usercfg.HealthCheck{Type: "http", ExpectedStatus: []string{"299-200"}})
+
+	assert.NoError(t, err1, "should not produce an error")
+	assert.Equal(t, 2*time.Second, hc1.Interval, "interval should match")
+	assert.Equal(t, 500*time.Millisecond, hc1.Timeout, "timeout should match")
+	assert.Equal(t, "HEAD", hc1.Method, "method should be upper case")
+	assert.Equal(t, "HTTP/2", hc1.Version, "version should match")
+	assert.Equal(t, []univcfg.StatusRange{{Start: 200, End: 299}, {Start: 404, End: 404}}, hc1.ExpectedStatuses,
+		"expected statuses should match")
+
+	assert.NoError(t, err2, "should not produce an error")
+	assert.Equal(t, 5*time.Second, hc2.Timeout, "timeout should default to 5 seconds")
+	assert.Equal(t, "GET", hc2.Method, "method should default to GET")
+	assert.Equal(t, "HTTP/1.1", hc2.Version, "version should default to HTTP/1.1")
+	assert.Equal(t, []univcfg.StatusRange{{Start: 200, End: 399}}, hc2.ExpectedStatuses, "2xx and 3xx should be healthy by default")
+
+	assert.EqualError(t, err3, "invalid health check method: CONNECT", "should fail on unsupported method")
+	assert.EqualError(t, err4, "invalid health check version: HTTP/3", "should fail on unsupported version")
+	assert.EqualError(t, err5, "invalid health check status: 299-200", "should fail on backwards range")
+}
+
+func TestAddRoutesMatchConditions(t *testing.T) {
+	endpoints := usercfg.Server{
+		Endpoints: []usercfg.Endpoint{{
+			Address: "endpoint.address",
+		}},
+	}
+	p := BagParser{
+		Bags: []usercfg.Bag{{
+			Availability: []string{"internal"},
+			Backends: []usercfg.Backend{
+				{
+					Match: usercfg.Match{
+						Methods: []string{"post", "PUT"},
+						Headers: []usercfg.HeaderMatch{{Name: "Accept-Version", Value: "2"}},
+						QueryParams: []usercfg.QueryParamMatch{
+							{Name: "debug", Type: "present"},
+						},
+					},
+					Server: endpoints,
+				},
+				{
+					Server: endpoints,
+				},
+			},
+			Id: "cars-v3",
+		}},
+		Config:       *univcfg.NewConfig(),
+		ListenerInfo: lconfig,
+	}
+	p.AddListeners()
+	err := p.AddRoutes()
+	assert.NoError(t, err, "AddRoutes should not produce an error")
+	assert.Equal(t, 2, len(p.Config.Routes), "backends on the same path with different conditions should get their own route")
+
+	var conditioned *univcfg.Route
+	for name, r := range p.Config.Routes {
+		if name != "cars-v3-in" {
+			conditioned = r
+		}
+	}
+	assert.Regexp(t, "^cars-v3-[0-9a-f]{8}-in$", conditioned.ClusterName, "conditioned route should have a match key in its name")
+	assert.Equal(t, "/cars/v3", conditioned.Path, "conditioned route should keep the bag path")
+	assert.Equal(t, []string{"POST", "PUT"}, conditioned.Methods, "methods should be upper case")
+	assert.Equal(t, []univcfg.HeaderMatch{{Name: "Accept-Version", Type: "exact", Value: "2"}}, conditioned.Headers,
+		"header match should default to exact")
+	assert.Equal(t, []univcfg.QueryParamMatch{{Name: "debug", Type: "present"}}, conditioned.QueryParams,
+		"query param match should carry through")
+
+	_, _, _, err1 := convertMatchConditions(usercfg.Match{Headers: []usercfg.HeaderMatch{{Name: "x", Type: "regex", Value: "("}}})
+	_, _, _, err2 := convertMatchConditions(usercfg.Match{Methods: []string{"FETCH"}})
+	_, _, _, err3 := convertMatchConditions(usercfg.Match{QueryParams: []usercfg.QueryParamMatch{{Name: "q", Type: "prefix"}}})
+	assert.ErrorContains(t, err1, "invalid header regex for x", "should fail on bad regex")
+	assert.EqualError(t, err2, "invalid match method: FETCH", "should fail on unknown method")
+	assert.EqualError(t, err3, "query parameter match for q is missing a value", "should fail on missing value")
+}
+
+func TestAddRoutesRewrite(t *testing.T) {
+	p := BagParser{
+		Bags: []usercfg.Bag{{
+			Availability: []string{"internal"},
+			Backends: []usercfg.Backend{
+				{
+					Rewrite: usercfg.Rewrite{Prefix: "/"},
+					Server: usercfg.Server{Endpoints: []usercfg.Endpoint{
+						{Address: "https://endpoint.address1/api/"},
+						{Address: "endpoint.address2:8443/api"},
+					}},
+				},
+				{
+					Match: usercfg.Match{Path: usercfg.Path{Pattern: "/cars/v3/old"}},
+					Server: usercfg.Server{Endpoints: []usercfg.Endpoint{
+						{Address: "endpoint.address1"},
+					}},
+				},
+			},
+			Id: "cars-v3",
+		}},
+		Config:       *univcfg.NewConfig(),
+		ListenerInfo: lconfig,
+	}
+	p.AddListeners()
+	p.AddClusters()
+	err := p.AddEndpoints()
+	assert.NoError(t, err, "AddEndpoints should not produce an error")
+	err = p.AddRoutes()
+	assert.NoError(t, err, "AddRoutes should not produce an error")
+
+	assert.Equal(t, "endpoint.address1", p.Config.Endpoints["cars-v3-in"][0].Address, "url path shouldn't be part of the address")
+	assert.Equal(t, uint(8443), p.Config.Endpoints["cars-v3-in"][1].Port, "port should still come from the url")
+	assert.Equal(t, "/api", p.Config.Routes["cars-v3-in"].PrefixRewrite, "base path should replace the stripped prefix")
+	assert.Equal(t, "", p.Config.Routes["cars-v3-old-in"].PrefixRewrite, "routes without a rewrite or base path keep their path")
+
+	prefix, regex, err := convertRewrite(usercfg.Rewrite{}, "starts_with", "/api")
+	assert.Equal(t, "", prefix, "base path alone shouldn't have a prefix rewrite")
+	assert.Equal(t, &univcfg.RegexRewrite{Pattern: "^(.*)$", Substitution: "/api\\1"}, regex, "base path should go in front of the full path")
+	assert.NoError(t, err, "base path without a rewrite should be valid")
+
+	prefix, regex, err = convertRewrite(usercfg.Rewrite{}, "regex", "/api")
+	assert.Equal(t, &univcfg.RegexRewrite{Pattern: "^(.*)$", Substitution: "/api\\1"}, regex, "regex paths should keep their full path behind the base path too")
+	assert.NoError(t, err, "base path on a regex path should be valid")
+
+	prefix, regex, err = convertRewrite(usercfg.Rewrite{Prefix: "/v2/"}, "starts_with", "/api")
+	assert.Equal(t, "/api/v2", prefix, "base path should go in front of the rewrite")
+	assert.Nil(t, regex, "prefix rewrite shouldn't have a regex rewrite")
+	assert.NoError(t, err, "prefix rewrite should be valid")
+
+	prefix, regex, err = convertRewrite(usercfg.Rewrite{Regex: usercfg.RegexRewrite{Pattern: "^/cars/v3/(.*)$", Substitution: "/\\1"}}, "regex", "/api")
+	assert.Equal(t, "", prefix, "regex rewrite shouldn't have a prefix rewrite")
+	assert.Equal(t, &univcfg.RegexRewrite{Pattern: "^/cars/v3/(.*)$", Substitution: "/api/\\1"}, regex, "base path should go in front of the substitution")
+	assert.NoError(t, err, "regex rewrite should be valid")
+
+	_, _, err1 := convertRewrite(usercfg.Rewrite{Prefix: "/", Regex: usercfg.RegexRewrite{Pattern: "^/"}}, "starts_with", "")
+	_, _, err2 := convertRewrite(usercfg.Rewrite{Prefix: "/"}, "regex", "")
+	_, _, err3 := convertRewrite(usercfg.Rewrite{Regex: usercfg.RegexRewrite{Pattern: "("}}, "starts_with", "")
+	_, _, err4 := convertRewrite(usercfg.Rewrite{Regex: usercfg.RegexRewrite{Pattern: "/v3/", Substitution: "/"}}, "starts_with", "/api")
+	assert.EqualError(t, err1, "rewrite can have a prefix or a regex, not both", "should fail with both rewrites")
+	assert.EqualError(t, err2, "regex paths can only be rewritten with a regex rewrite", "should fail on prefix rewrite of a regex path")
+	assert.ErrorContains(t, err3, "invalid rewrite regex", "should fail on bad regex")
+	assert.EqualError(t, err4, "rewrite regex has to start with ^ when the endpoints have a base path (/api)", "should fail on unanchored regex with a base path")
+
+	_, err = backendBasePath(usercfg.Backend{Server: usercfg.Server{Endpoints: []usercfg.Endpoint{
+		{Address: "endpoint.address1/api"},
+		{Address: "endpoint.address2/other"},
+	}}})
+	assert.EqualError(t, err, "endpoints of a backend must share the same base path, got \"/api\" and \"/other\"", "endpoints should agree on base path")
+}
+
+func TestConvertRetry(t *testing.T) {
+	retry, err := convertRetry(usercfg.Retry{})
+	assert.Nil(t, retry, "no retry count should mean no retries")
+	assert.NoError(t, err, "empty retry should be valid")
+
+	retry, err = convertRetry(usercfg.Retry{Count: 2, PerTryTimeout: "1s"})
+	assert.Equal(t, &univcfg.RetryPolicy{Count: 2, On: []string{"connect-failure", "refused-stream"}, PerTryTimeout: time.Second}, retry,
+		"retries should default to connection failures")
+	assert.NoError(t, err, "retry should be valid")
+
+	_, err1 := convertRetry(usercfg.Retry{On: []string{"5xx"}})
+	_, err2 := convertRetry(usercfg.Retry{Count: 1, On: []string{"timeout"}})
+	_, err3 := convertRetry(usercfg.Retry{Count: 1, PerTryTimeout: "soon"})
+	assert.EqualError(t, err1, "retry settings need a retry count", "should fail without a count")
+	assert.EqualError(t, err2, "invalid retry condition: timeout", "should fail on unknown condition")
+	assert.EqualError(t, err3, "can't parse duration: soon", "should fail on bad per try timeout")
+}
+
+func TestSplits(t *testing.T) {
+	p := BagParser{
+		Bags: []usercfg.Bag{{
+			Availability: []string{"internal"},
+			Backends: []usercfg.Backend{{
+				Server: usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "stable.address"}}},
+				Splits: []usercfg.Split{{
+					Name:   "canary",
+					Server: usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "canary.address"}}},
+					Weight: 5,
+				}},
+			}},
+			Id: "cars-v3",
+		}},
+		Config:       *univcfg.NewConfig(),
+		ListenerInfo: lconfig,
+	}
+	p.AddListeners()
+	assert.NoError(t, p.AddClusters(), "AddClusters should not produce an error")
+	assert.NoError(t, p.AddEndpoints(), "AddEndpoints should not produce an error")
+	assert.NoError(t, p.AddRoutes(), "AddRoutes should not produce an error")
+
+	assert.NotNil(t, p.Config.Clusters["cars-v3+canary-in"], "split should get its own cluster")
+	assert.Equal(t, "canary.address", p.Config.Endpoints["cars-v3+canary-in"][0].Address, "split endpoints should go to the split cluster")
+	assert.Equal(t, []univcfg.WeightedCluster{{Name: "cars-v3-in", Weight: 95}, {Name: "cars-v3+canary-in", Weight: 5}},
+		p.Config.Routes["cars-v3-in"].Splits, "servers should get the weight the splits leave over")
+	assert.Equal(t, []string{"cars-v3-in"}, p.Config.Listeners["internal"].Routes, "split clusters shouldn't get their own routes")
+
+	split := func(name string, weight uint) usercfg.Split {
+		return usercfg.Split{Name: name, Weight: weight, Server: usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: name}}}}
+	}
+	splits, err := convertSplits("cars-v3-in", usercfg.Backend{Splits: []usercfg.Split{split("blue", 100), split("green", 0)}})
+	assert.Equal(t, []univcfg.WeightedCluster{{Name: "cars-v3+blue-in", Weight: 100}}, splits, "empty weights should be left out")
+	assert.NoError(t, err, "splits adding up to 100 shouldn't need servers")
+
+	_, err1 := convertSplits("cars-v3-in", usercfg.Backend{Splits: []usercfg.Split{split("blue", 60), split("green", 50)}})
+	_, err2 := convertSplits("cars-v3-in", usercfg.Backend{Splits: []usercfg.Split{split("blue", 60)}})
+	_, err3 := convertSplits("cars-v3-in", usercfg.Backend{Splits: []usercfg.Split{split("blue", 10), split("blue", 10)}})
+	assert.EqualError(t, err1, "split weights add up to 110%, can't be more than 100%", "should fail over 100")
+	assert.EqualError(t, err2, "split weights add up to 60%, must be 100% when the backend has no servers", "should fail without servers")
+	assert.EqualError(t, err3, "duplicate split name: blue", "should fail on duplicate names")
+}
+
+func TestConvertHeaderRules(t *testing.T) {
+	bag := usercfg.Headers{
+		Request: usercfg.HeaderActions{
+			Add:    map[string]string{"x-team": "cars"},
+			Remove: []string{"X-Debug"},
+			Set:    map[string]string{"x-forwarded-prefix": "/cars/v3", "x-env": "dev"},
+		},
+	}
+	backend := usercfg.Headers{
+		Request: usercfg.HeaderActions{
+			Add:    map[string]string{"x-team": "reports"},
+			Remove: []string{"x-debug", "x-internal"},
+			Set:    map[string]string{"X-Env": "canary"},
+		},
+		Response: usercfg.HeaderActions{
+			Set: map[string]string{"x-frame-options": "DENY"},
+		},
+	}
+
+	rules, err := convertHeaderRules(bag, backend)
+	assert.NoError(t, err, "header rules should be valid")
+	assert.Equal(t, []univcfg.HeaderValue{{Name: "x-team", Value: "cars"}, {Name: "x-team", Value: "reports"}},
+		rules.Request.Add, "added headers from the bag and backend should both be kept")
+	assert.Equal(t, []univcfg.HeaderValue{{Name: "x-env", Value: "canary"}, {Name: "x-forwarded-prefix", Value: "/cars/v3"}},
+		rules.Request.Set, "backend should win when setting the same header")
+	assert.Equal(t, []string{"x-debug", "x-internal"}, rules.Request.Remove, "removed headers should be merged")
+	assert.Equal(t, []univcfg.HeaderValue{{Name: "x-frame-options", Value: "DENY"}}, rules.Response.Set, "response headers should carry through")
+
+	_, err1 := convertHeaderRules(usercfg.Headers{Request: usercfg.HeaderActions{Set: map[string]string{":path": "/"}}}, usercfg.Headers{})
+	_, err2 := convertHeaderRules(usercfg.Headers{}, usercfg.Headers{Response: usercfg.HeaderActions{Remove: []string{"Host"}}})
+	assert.EqualError(t, err1, "request headers: can't change header: :path", "should fail on pseudo header")
+	assert.EqualError(t, err2, "response headers: can't change header: host", "should fail on host header")
+}
+
+func TestParseListenerHeaders(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "headers.json")
+	os.WriteFile(good, []byte(`{"external": {"request": {"remove": ["x-debug"]}}}`), 0644)
+	badName := filepath.Join(dir, "name.yaml")
+	os.WriteFile(badName, []byte("outside:\n  request:\n    remove: [x-debug]\n"), 0644)
+	badKey := filepath.Join(dir, "key.yaml")
+	os.WriteFile(badKey, []byte("external:\n  requests:\n    remove: [x-debug]\n"), 0644)
+
+	rules, err := ParseListenerHeaders(good)
+	assert.NoError(t, err, "listener headers should be valid")
+	assert.Equal(t, []string{"x-debug"}, rules["external"].Request.Remove, "external listener should remove header")
+	assert.Empty(t, rules["internal"].Request.Remove, "internal listener shouldn't change headers")
+
+	_, err = ParseListenerHeaders(badName)
+	assert.EqualError(t, err, badName+": invalid listener name: outside", "should fail on unknown listener")
+	_, err = ParseListenerHeaders(badKey)
+	assert.ErrorContains(t, err, "field requests not found", "should fail on unknown field")
+}
+
+func TestConvertCors(t *testing.T) {
+	bagCors := usercfg.Cors{
+		AllowMethods: []string{"get", "POST"},
+		AllowOrigins: []usercfg.CorsOrigin{
+			{Value: "https://www.target.com"},
+			{Type: "regex", Value: `https://.*\.target\.com`},
+		},
+		MaxAge: "10m",
+	}
+	cors, err := convertCors(bagCors, usercfg.Cors{})
+	assert.NoError(t, err, "bag cors should be valid")
+	assert.Equal(t, &univcfg.CorsPolicy{
+		AllowMethods: []string{"GET", "POST"},
+		AllowOrigins: []univcfg.CorsOrigin{
+			{Type: "exact", Value: "https://www.target.com"},
+			{Type: "regex", Value: `https://.*\.target\.com`},
+		},
+		MaxAge: 10 * time.Minute,
+	}, cors, "backend should use the bag's cors policy")
+
+	cors, err = convertCors(bagCors, usercfg.Cors{
+		AllowCredentials: true,
+		AllowOrigins:     []usercfg.CorsOrigin{{Value: "https://reports.target.com"}},
+	})
+	assert.NoError(t, err, "backend cors should be valid")
+	assert.Equal(t, &univcfg.CorsPolicy{
+		AllowCredentials: true,
+		AllowOrigins:     []univcfg.CorsOrigin{{Type: "exact", Value: "https://reports.target.com"}},
+	}, cors, "backend's own cors policy should replace the bag's")
+
+	cors, err = convertCors(usercfg.Cors{}, usercfg.Cors{})
+	assert.Nil(t, cors, "no origins should mean no cors policy")
+	assert.NoError(t, err, "no cors should be valid")
+
+	_, err1 := convertCors(usercfg.Cors{MaxAge: "1m"}, usercfg.Cors{})
+	_, err2 := convertCors(usercfg.Cors{AllowOrigins: []usercfg.CorsOrigin{{Type: "regex", Value: "("}}}, usercfg.Cors{})
+	_, err3 := convertCors(usercfg.Cors{AllowOrigins: []usercfg.CorsOrigin{{Value: "*"}}, MaxAge: "500ms"}, usercfg.Cors{})
+	assert.EqualError(t, err1, "cors settings need at least one allowed origin", "should fail without origins")
+	assert.ErrorContains(t, err2, "invalid cors origin regex", "should fail on bad regex")
+	assert.EqualError(t, err3, "cors max age must be at least 1s: 500ms", "should fail on max age under a second")
+}
+
+func TestConvertResponse(t *testing.T) {
+	bag := usercfg.Bag{Id: "cars-v3"}
+	servers := usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "endpoint.address"}}}
+
+	direct, redirect, err := convertResponse(bag, usercfg.Backend{Server: servers})
+	assert.Nil(t, direct, "backend with servers shouldn't answer requests itself")
+	assert.Nil(t, redirect, "backend with servers shouldn't redirect")
+	assert.NoError(t, err, "plain backend should be valid")
+
+	direct, _, err = convertResponse(bag, usercfg.Backend{Maintenance: true, Server: servers})
+	assert.Equal(t, &univcfg.DirectResponse{Status: 503, Body: "cars-v3 is down for maintenance"}, direct, "maintenance should default its message")
+	assert.NoError(t, err, "maintenance should be valid")
+
+	direct, _, err = convertResponse(bag, usercfg.Backend{Maintenance: true, Message: "back at 5pm"})
+	assert.Equal(t, &univcfg.DirectResponse{Status: 503, Body: "back at 5pm"}, direct, "maintenance message should match")
+	assert.NoError(t, err, "maintenance without servers should be valid")
+
+	direct, _, err = convertResponse(bag, usercfg.Backend{Direct: usercfg.Direct{Status: 410, Body: "gone"}})
+	assert.Equal(t, &univcfg.DirectResponse{Status: 410, Body: "gone"}, direct, "direct response should match")
+	assert.NoError(t, err, "direct response should be valid")
+
+	direct, _, err = convertResponse(bag, usercfg.Backend{})
+	assert.Equal(t, &univcfg.DirectResponse{Status: 503, Body: "cars-v3 has no servers"}, direct, "backend without servers should answer with a 503")
+	assert.NoError(t, err, "backend without servers should be valid")
+
+	_, redirect, err = convertResponse(bag, usercfg.Backend{Redirect: usercfg.Redirect{Host: "cars.target.com:8443", Prefix: "/cars/v4", Status: 308}})
+	assert.Equal(t, &univcfg.Redirect{Host: "cars.target.com", Port: 8443, Prefix: "/cars/v4", Status: 308}, redirect, "redirect should match")
+	assert.NoError(t, err, "redirect should be valid")
+
+	_, redirect, _ = convertResponse(bag, usercfg.Backend{Redirect: usercfg.Redirect{Scheme: "https"}})
+	assert.Equal(t, uint(301), redirect.Status, "redirect should default to 301")
+
+	_, _, err1 := convertResponse(bag, usercfg.Backend{Maintenance: true, Redirect: usercfg.Redirect{Path: "/"}})
+	_, _, err2 := convertResponse(bag, usercfg.Backend{Redirect: usercfg.Redirect{Path: "/", Prefix: "/"}})
+	_, _, err3 := convertResponse(bag, usercfg.Backend{Redirect: usercfg.Redirect{Status: 200}})
+	_, _, err4 := convertResponse(bag, usercfg.Backend{Direct: usercfg.Direct{Body: "missing status"}})
+	assert.EqualError(t, err1, "backend can only have one of direct_response, redirect and maintenance", "should fail with several responses")
+	assert.EqualError(t, err2, "redirect can have a path or a prefix, not both", "should fail with path and prefix")
+	assert.EqualError(t, err3, "invalid redirect status: 200", "should fail on non redirect status")
+	assert.EqualError(t, err4, "invalid direct response status: 0", "should fail on missing status")
+}
+
+func TestAddClustersResilience(t *testing.T) {
+	p := BagParser{
+		Bags: []usercfg.Bag{{
+			Availability: []string{"internal"},
+			Backends: []usercfg.Backend{
+				{
+					Breaker: usercfg.Breaker{MaxConnections: 100, MaxRequests: 200},
+					Outlier: usercfg.Outlier{Consecutive5xx: 3, EjectionTime: "1m"},
+					Server:  usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "stable.address"}}},
+					Splits: []usercfg.Split{{
+						Name:   "canary",
+						Server: usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "canary.address"}}},
+						Weight: 10,
+					}},
+				},
+				{
+					Match:  usercfg.Match{Path: usercfg.Path{Pattern: "/cars/v3/plain"}},
+					Server: usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "plain.address"}}},
+				},
+			},
+			Id: "cars-v3",
+		}},
+		Config:       *univcfg.NewConfig(),
+		ListenerInfo: lconfig,
+	}
+	err := p.AddClusters()
+	assert.NoError(t, err, "AddClusters should not produce an error")
+
+	breaker := &univcfg.CircuitBreaker{MaxConnections: 100, MaxRequests: 200}
+	outlier := &univcfg.OutlierDetection{Consecutive5xx: 3, EjectionTime: time.Minute}
+	assert.Equal(t, breaker, p.Config.Clusters["cars-v3-in"].CircuitBreaker, "circuit breaker should match")
+	assert.Equal(t, outlier, p.Config.Clusters["cars-v3-in"].OutlierDetection, "outlier detection should match")
+	assert.Equal(t, breaker, p.Config.Clusters["cars-v3+canary-in"].CircuitBreaker, "splits should share the circuit breaker")
+	assert.Equal(t, outlier, p.Config.Clusters["cars-v3+canary-in"].OutlierDetection, "splits should share outlier detection")
+	assert.Nil(t, p.Config.Clusters["cars-v3-plain-in"].CircuitBreaker, "backend without limits shouldn't have a circuit breaker")
+	assert.Nil(t, p.Config.Clusters["cars-v3-plain-in"].OutlierDetection, "backend without outlier settings shouldn't have outlier detection")
+
+	_, err1 := convertOutlier(usercfg.Outlier{MaxEjectionPercent: 150})
+	_, err2 := convertOutlier(usercfg.Outlier{EjectionTime: "forever"})
+	assert.EqualError(t, err1, "max ejection percent can't be more than 100: 150", "should fail over 100 percent")
+	assert.EqualError(t, err2, "can't parse duration: forever", "should fail on bad ejection time")
+}
+
+func TestConvertBalance(t *testing.T) {
+	tests := []struct {
+		balance string
+		policy  string
+		hash    *univcfg.HashPolicy
+	}{
+		{"", "round_robin", nil},
+		{"roundrobin", "round_robin", nil},
+		{"static-rr", "round_robin", nil},
+		{"leastconn", "least_request", nil},
+		{"random", "random", nil},
+		{"first", "first", nil},
+		{"source", "ring_hash", &univcfg.HashPolicy{Type: "source_ip"}},
+		{"uri", "ring_hash", &univcfg.HashPolicy{Type: "path"}},
+		{"hdr(x-user-id)", "ring_hash", &univcfg.HashPolicy{Type: "header", Name: "x-user-id"}},
+		{"url_param(session)", "ring_hash", &univcfg.HashPolicy{Type: "query_param", Name: "session"}},
+		{"rdp-cookie(sticky)", "ring_hash", &univcfg.HashPolicy{Type: "cookie", Name: "sticky"}},
+	}
+	for _, test := range tests {
+		policy, hash, err := convertBalance(test.balance)
+		assert.NoError(t, err, "%s should be valid", test.balance)
+		assert.Equal(t, test.policy, policy, "%s should map to %s", test.balance, test.policy)
+		assert.Equal(t, test.hash, hash, "%s hash policy should match", test.balance)
+	}
+
+	for _, balance := range []string{"leastconn2", "hdr", "hdr()", "source(ip)", "weighted"} {
+		_, _, err := convertBalance(balance)
+		assert.EqualError(t, err, "invalid balance algorithm: "+balance, "%s should be invalid", balance)
+	}
+}
+
+func TestConvertDns(t *testing.T) {
+	one := usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "address1"}}}
+	two := usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "address1"}, {Address: "address2"}}}
+
+	dnsType, err := convertDns(usercfg.Backend{Server: two})
+	assert.Equal(t, "strict", dnsType, "dns should default to strict")
+	assert.NoError(t, err, "strict dns should allow several endpoints")
+
+	dnsType, err = convertDns(usercfg.Backend{Dns: "logical", Server: one, Splits: []usercfg.Split{{Name: "canary", Server: one}}})
+	assert.Equal(t, "logical", dnsType, "logical dns should be kept")
+	assert.NoError(t, err, "logical dns should allow one endpoint per server group")
+
+	_, err1 := convertDns(usercfg.Backend{Dns: "logical", Server: two})
+	_, err2 := convertDns(usercfg.Backend{Dns: "logical", Server: one, Splits: []usercfg.Split{{Name: "canary", Server: two}}})
+	_, err3 := convertDns(usercfg.Backend{Dns: "eds"})
+	assert.EqualError(t, err1, "logical dns backends can only have one endpoint per server group", "should fail with several endpoints")
+	assert.EqualError(t, err2, "logical dns backends can only have one endpoint per server group", "should fail with several split endpoints")
+	assert.EqualError(t, err3, "invalid dns type: eds", "should fail on unknown dns type")
+}
+
+func TestConvertTls(t *testing.T) {
+	https := []usercfg.Endpoint{{Address: "https://address1"}, {Address: "address1", Port: 443}}
+	mixed := []usercfg.Endpoint{{Address: "http://address1"}, {Address: "https://10.0.0.1"}}
+	plain := []usercfg.Endpoint{{Address: "http://address1"}, {Address: "address2", Port: 8080}}
+	defaults := univcfg.UpstreamTls{CaFile: "ca.crt", CertFile: "client.crt", KeyFile: "client.key"}
+
+	assert.False(t, usesTls(plain[1], 8080), "endpoint without a scheme should only use https on 443")
+	assert.True(t, usesTls(https[1], 443), "endpoint without a scheme should use https on 443")
+	assert.True(t, usesTls(usercfg.Endpoint{Address: "https://address1:8443"}, 8443), "https scheme should use https on any port")
+
+	upstreamTls, err := convertTls(usercfg.Tls{}, plain, defaults)
+	assert.NoError(t, err, "plain endpoints shouldn't produce an error")
+	assert.Nil(t, upstreamTls, "plain endpoints shouldn't use tls")
+
+	upstreamTls, err = convertTls(usercfg.Tls{}, https, defaults)
+	assert.NoError(t, err, "https endpoints shouldn't produce an error")
+	assert.Equal(t, "address1", upstreamTls.Sni, "sni should default to the endpoints' hostname")
+	assert.Equal(t, "ca.crt", upstreamTls.CaFile, "daemon's ca should be used")
+	assert.Equal(t, "client.crt", upstreamTls.CertFile, "daemon's client cert should be used")
+	assert.Equal(t, "client.key", upstreamTls.KeyFile, "daemon's client key should be used")
+
+	assert.Equal(t, []string{"address1"}, upstreamTls.SubjectAltNames, "certificate should be checked against the sni")
+
+	upstreamTls, err = convertTls(usercfg.Tls{Insecure: true}, mixed, defaults)
+	assert.NoError(t, err, "insecure tls should be valid")
+	assert.Equal(t, "", upstreamTls.Sni, "ip endpoints shouldn't get an sni")
+	assert.Equal(t, "", upstreamTls.CaFile, "insecure endpoints shouldn't be verified against the default ca")
+	assert.Empty(t, upstreamTls.SubjectAltNames, "insecure endpoints shouldn't check subject alt names")
+
+	hostnames := []usercfg.Endpoint{{Address: "https://address1"}, {Address: "https://address2"}}
+	upstreamTls, err = convertTls(usercfg.Tls{}, hostnames, defaults)
+	assert.NoError(t, err, "endpoints with different hostnames should be valid")
+	assert.Equal(t, "", upstreamTls.Sni, "endpoints with different hostnames shouldn't share an sni")
+	assert.True(t, upstreamTls.AutoSni, "each endpoint should be sent its own hostname")
+	assert.Empty(t, upstreamTls.SubjectAltNames, "certificates should be checked against each endpoint's own hostname")
+
+	userTls := usercfg.Tls{Ca: "bag.crt", Cert: "bag-client.crt", Key: "bag-client.key", Sni: "api.target.com", VerifySan: []string{"api.target.com"}}
+	upstreamTls, _ = convertTls(userTls, https, defaults)
+	assert.Equal(t, "api.target.com", upstreamTls.Sni, "bag's sni should be used")
+	assert.Equal(t, "bag.crt", upstreamTls.CaFile, "bag's ca should win over the default")
+	assert.Equal(t, "bag-client.crt", upstreamTls.CertFile, "bag's client cert should win over the default")
+	assert.Equal(t, "bag-client.key", upstreamTls.KeyFile, "bag's client key should win over the default")
+	assert.Equal(t, []string{"api.target.com"}, upstreamTls.SubjectAltNames, "subject alt names should be kept")
+
+	_, err1 := convertTls(usercfg.Tls{Cert: "bag-client.crt"}, https, univcfg.UpstreamTls{})
+	_, err2 := convertTls(usercfg.Tls{VerifySan: []string{"api.target.com"}}, https, univcfg.UpstreamTls{})
+	_, err3 := convertTls(usercfg.Tls{}, https, univcfg.UpstreamTls{})
+	_, err4 := convertTls(usercfg.Tls{Insecure: true, Ca: "bag.crt"}, https, defaults)
+	_, err5 := convertTls(usercfg.Tls{}, append(hostnames, usercfg.Endpoint{Address: "https://10.0.0.1"}), defaults)
+	_, err6 := convertTls(usercfg.Tls{}, []usercfg.Endpoint{{Address: "https://10.0.0.1"}}, defaults)
+	assert.EqualError(t, err1, "tls client certificate and key have to be set together", "should fail on a cert without key")
+	assert.EqualError(t, err2, "verifying subject alt names needs a ca", "should fail on subject alt names without a ca")
+	assert.ErrorContains(t, err3, "https endpoints need a ca", "should fail on https endpoints that can't be verified")
+	assert.EqualError(t, err4, "insecure tls can't verify against a ca or subject alt names", "should fail on insecure tls with a ca")
+	assert.ErrorContains(t, err5, "need a tls sni", "should fail on different hosts with ip addresses")
+	assert.ErrorContains(t, err6, "https ip endpoints need a tls sni or verify_san", "should fail on ip endpoints without a name to verify")
+
+	ips := []usercfg.Endpoint{{Address: "https://10.0.0.1"}, {Address: "10.0.0.2", Port: 443}}
+	upstreamTls, err = convertTls(usercfg.Tls{VerifySan: []string{"api.target.com"}}, ips, defaults)
+	assert.NoError(t, err, "ip endpoints with subject alt names should be valid")
+	assert.Equal(t, "", upstreamTls.Sni, "ip endpoints shouldn't get an sni of their own")
+	assert.Equal(t, []string{"api.target.com"}, upstreamTls.SubjectAltNames, "ip endpoints should be checked against the subject alt names")
+	upstreamTls, err = convertTls(usercfg.Tls{Sni: "api.target.com"}, ips, defaults)
+	assert.NoError(t, err, "ip endpoints with an sni should be valid")
+	assert.Equal(t, []string{"api.target.com"}, upstreamTls.SubjectAltNames, "ip endpoints should be checked against the sni")
+}
+
+func TestAddClustersTls(t *testing.T) {
+	bp := BagParser{
+		Bags: []usercfg.Bag{{
+			Id:           "cars-v3",
+			Availability: []string{"internal"},
+			Backends: []usercfg.Backend{{
+				Server: usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "http://cars.target.com"}}},
+				Splits: []usercfg.Split{{
+					Name:   "canary",
+					Server: usercfg.Server{Endpoints: []usercfg.Endpoint{{Address: "https://canary.target.com"}}},
+					Weight: 10,
+				}},
+				Tls: usercfg.Tls{Sni: "cars.target.com"},
+			}},
+		}},
+		Config:       *univcfg.NewConfig(),
+		ListenerInfo: lconfig,
+	}
+	assert.NoError(t, bp.AddClusters(), "AddClusters should not produce an error")
+	assert.NoError(t, bp.AddEndpoints(), "AddEndpoints should not produce an error")
+	assert.Nil(t, bp.Config.Clusters["cars-v3-in"].Tls, "http server group shouldn't use tls")
+	assert.Equal(t, "cars.target.com", bp.Config.Clusters["cars-v3+canary-in"].Tls.Sni, "https split should use tls")
+	assert.False(t, bp.Config.Endpoints["cars-v3-in"][0].Tls, "http endpoint shouldn't be marked as https")
+	assert.True(t, bp.Config.Endpoints["cars-v3+canary-in"][0].Tls, "https endpoint should be marked as https")
+
+	bp.Bags[0].Backends[0].Splits = nil
+	bp.Config = *univcfg.NewConfig()
+	assert.EqualError(t, bp.AddClusters(), "tls settings given, but none of the endpoints use https", "tls settings without https endpoints should fail")
+}
@@ -2,11 +2,15 @@ package processor
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"time"
 
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
@@ -21,122 +25,462 @@ import (
 	watcher "github.com/fmgornick/dynamic-proxy/app/watcher"
 )
 
+// snapshot versions are cut down to this many hex characters of their hash
+const versionLength = 16
+
 type EnvoyProcessor struct {
-	AddHttp      bool                       // controls whether or not proxy listents on HTTP or HTTPS
-	Cache        cache.SnapshotCache        // snapshot config (output for envoyproxy)
-	Configs      map[string]*univcfg.Config // map of universal configs
-	ListenerInfo univcfg.ListenerInfo       // info on what ports and addresses to listen on
-	Node         string                     // name of node for snapshot
-	Version      uint                       // keeps track of version number for our envoyproxy config
+	AddHttp        bool                       // controls whether or not proxy listents on HTTP or HTTPS
+	Added          map[string]time.Time       // modification time of each config's file when it was first added, the older of two conflicting configs wins
+	BagIds         map[string][]string        // ids of the bags in each file, used to find overlays patching bags that don't exist
+	Cache          cache.SnapshotCache        // snapshot config (output for envoyproxy)
+	Configs        map[string]*univcfg.Config // map of universal configs, one per bag ("path" or "path#id" if the file holds several)
+	ConflictPolicy string                     // "newer" leaves out the newer of two configs claiming the same name, "both" leaves out both
+	Conflicts      []univcfg.Conflict         // conflicts found making the last snapshot
+	Env            string                     // environment whose overlays get merged into the bags, overlays are ignored if empty
+	ListenerInfo   univcfg.ListenerInfo       // info on what ports and addresses to listen on
+	Node           string                     // name of node for snapshot
+	Overlays       map[string]usercfg.Overlay // overlays of our environment, keyed by file path
+	Quarantined    map[string]string          // files whose latest version was rejected and why, their last good configs are still served
+	RegionPriority map[string]uint32          // failover priority of each endpoint region, unlisted regions get 0
+	Version        string                     // hash of the config envoy was last sent, empty until the first snapshot
+}
+
+// a rejected file, see QuarantinedFiles
+type Quarantined struct {
+	Path   string // path of the file
+	Reason string // why its latest version was rejected, or the conflict it lost
 }
 
 func NewProcessor(node string, addHttp bool, listenerInfo univcfg.ListenerInfo) *EnvoyProcessor {
 	return &EnvoyProcessor{
-		AddHttp:      addHttp,
-		Cache:        cache.NewSnapshotCache(false, cache.IDHash{}, nil),
-		Configs:      make(map[string]*univcfg.Config),
-		ListenerInfo: listenerInfo,
-		Node:         node,
-		Version:      0,
+		AddHttp:        addHttp,
+		Added:          make(map[string]time.Time),
+		BagIds:         make(map[string][]string),
+		Cache:          cache.NewSnapshotCache(false, cache.IDHash{}, nil),
+		Configs:        make(map[string]*univcfg.Config),
+		ConflictPolicy: "newer",
+		ListenerInfo:   listenerInfo,
+		Node:           node,
+		Overlays:       make(map[string]usercfg.Overlay),
+		Quarantined:    make(map[string]string),
+		RegionPriority: make(map[string]uint32),
+		Version:        "",
+	}
+}
+
+// split the comma separated -regions flag, ignoring spaces around each region
+// an empty region would silently match nothing, so it's an error
+func ParseRegions(list string) ([]string, error) {
+	var regions []string
+	for _, region := range strings.Split(list, ",") {
+		region = strings.TrimSpace(region)
+		if region == "" {
+			return nil, fmt.Errorf("empty region in list: %q", list)
+		}
+		regions = append(regions, region)
 	}
+	return regions, nil
+}
+
+// turn list of regions ordered by preference into a priority map
+// the first region is our local datacenter and gets the highest priority (0)
+func RegionPriorities(regions []string) map[string]uint32 {
+	priorities := make(map[string]uint32)
+	for i, region := range regions {
+		priorities[region] = uint32(i)
+	}
+	return priorities
 }
 
 // take change, update configs map, update snapshot cache
+// a file that fails to process is quarantined, we keep serving its last good config along with every other file
+// the snapshot is still updated, the returned error lists every file that was rejected
 func (e *EnvoyProcessor) Process(msg watcher.Message) error {
+	return e.ProcessBatch([]watcher.Message{msg})
+}
+
+// take a batch of changes, update configs map for each of them, then update the snapshot cache once
+// envoy only sees the end result, not every step in between
+func (e *EnvoyProcessor) ProcessBatch(msgs []watcher.Message) error {
+	var failures []string
+	// files in a directory the batch walks through get read by the walk, wherever they are in the batch
+	var walked []string
+	for _, msg := range msgs {
+		if msg.Operation == watcher.Create || msg.Operation == watcher.Modify {
+			if info, err := os.Stat(msg.Path); err == nil && info.IsDir() {
+				walked = append(walked, msg.Path)
+			}
+		}
+	}
+	overlaysChanged := false
+	for _, msg := range msgs {
+		if msg.Operation != watcher.Move && msg.Operation != watcher.Delete && inDirectories(msg.Path, walked) {
+			continue
+		}
+		changed, err := e.applyChange(msg)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+		overlaysChanged = overlaysChanged || changed
+	}
+	// every bag is patched again once, after all of the batch's overlays are in
+	if overlaysChanged {
+		if err := e.reprocessBags(); err != nil {
+			failures = append(failures, fmt.Sprintf("failed to apply overlays: %+v", err))
+		}
+	}
+	// an overlay for a bag that doesn't exist (e.g. a typo in its id) would otherwise silently do nothing
+	// only checked once the whole batch is in, the bag could be in a file further down
+	if err := e.checkOverlays(); err != nil {
+		failures = append(failures, err.Error())
+	}
+	// generate new snapshot from configuration and update the cache
+	if err := e.setSnapshot(); err != nil {
+		failures = append(failures, err.Error())
+	}
+	if len(failures) != 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// update configs map for a single change, without touching the snapshot
+// returns true if overlays of our environment changed, the bags have to be patched again afterwards
+func (e *EnvoyProcessor) applyChange(msg watcher.Message) (bool, error) {
 	/* -------------------- MESSAGE CASES -------------------- */
 	// new file:     walk through if it's a directory, then call ProcessFile
 	// file changed: walk through if it's a directory, then call ProcessFile
 	// file deleted: delete corresponding config in map
 	// file moved:   delete corresponding config in map
-	if msg.Operation == watcher.Move || msg.Operation == watcher.Delete {
-		if _, ok := e.Configs[msg.Path]; ok {
-			delete(e.Configs, msg.Path)
-		} else {
-			// if it's a directory then delete every key corresponding to it's elements
-			for key := range e.Configs {
-				if strings.HasPrefix(key, msg.Path) {
-					delete(e.Configs, key)
-				}
-			}
-		}
-	} else {
+	var info os.FileInfo
+	var err error
+	if msg.Operation == watcher.Create || msg.Operation == watcher.Modify {
 		// check if file is a directory
-		info, err := os.Stat(msg.Path)
+		info, err = os.Stat(msg.Path)
+		if os.IsNotExist(err) {
+			// gone again before we got to read it (e.g. an editor's temporary file), so it's the same as a delete
+			msg.Operation = watcher.Delete
+		} else if err != nil {
+			return false, fmt.Errorf("path check error: %+v", err)
+		}
+	}
+
+	if msg.Operation == watcher.Move || msg.Operation == watcher.Delete {
+		// if it's a directory then this deletes every key corresponding to it's elements
+		e.deleteConfigs(msg.Path)
+		e.deleteQuarantined(msg.Path)
+		return e.deleteOverlays(msg.Path), nil
+	}
+
+	// if it's a file, then we want to call ProcessFile, to actually update the config
+	if !info.IsDir() {
+		changed, err := e.processPath(msg)
 		if err != nil {
-			return fmt.Errorf("path check error: %+v", err)
+			return changed, fmt.Errorf("failed to process file: %+v", err)
 		}
+		return changed, nil
+	}
 
-		// if it's a directory, then we want to call our operations on all the subdirectories and files
-		// if it's a file, then we want to call ProcessFile, to actually update the config
+	// if it's a directory, then we want to call our operations on all the files in it
+	var failures []string
+	overlaysChanged := false
+	err = filepath.Walk(msg.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if info.IsDir() {
-			err := filepath.Walk(msg.Path, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-
-				// don't want to recursively call ourself, otherwise it's an infinite loop
-				if path == msg.Path {
-					return nil
-				}
-
-				// process change for all the sub-directories via recursive call
-				// if it's a file, then we want to call ProcessFile, to actually update the config
-				if info.IsDir() {
-					return e.Process(watcher.Message{
-						Operation: msg.Operation,
-						Path:      path,
-					})
-				} else {
-					return e.processFile(watcher.Message{
-						Operation: msg.Operation,
-						Path:      path,
-					})
-				}
-			})
-			if err != nil {
-				return fmt.Errorf("failed to walk directory path: %+v", err)
-			}
-		} else {
-			err := e.processFile(msg)
-			if err != nil {
-				return fmt.Errorf("failed to process file: %+v", err)
-			}
+			return nil
+		}
+		// one bad file shouldn't stop us from picking up the rest
+		changed, err := e.processPath(watcher.Message{
+			Operation: msg.Operation,
+			Path:      path,
+		})
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+		overlaysChanged = overlaysChanged || changed
+		return nil
+	})
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("failed to walk directory path: %+v", err))
+	}
+	if len(failures) != 0 {
+		return overlaysChanged, fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return overlaysChanged, nil
+}
+
+// helper: check if a path is inside any of the directories
+func inDirectories(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// process a single bag or overlay file, quarantining it if it's rejected
+// returns true if an overlay of our environment was read, the bags it patches are parsed again at the end of the batch
+func (e *EnvoyProcessor) processPath(msg watcher.Message) (bool, error) {
+	if env, ok := overlayEnv(msg.Path); ok {
+		applied, err := e.processOverlay(msg.Path, env)
+		return applied, e.quarantine(msg.Path, err)
+	}
+	return false, e.quarantine(msg.Path, e.processFile(msg))
+}
+
+// keep track of whether the latest version of a file was rejected, passes the error through
+func (e *EnvoyProcessor) quarantine(path string, err error) error {
+	if err != nil {
+		e.Quarantined[path] = err.Error()
+	} else {
+		delete(e.Quarantined, path)
+	}
+	return err
+}
+
+// files whose latest version was rejected, in order, along with why
+// their last good configs are still being served, unlike files left out by a conflict, which are listed too
+func (e *EnvoyProcessor) QuarantinedFiles() []Quarantined {
+	files := make([]Quarantined, 0, len(e.Quarantined))
+	for path, reason := range e.Quarantined {
+		files = append(files, Quarantined{Path: path, Reason: reason})
+	}
+	for _, conflict := range e.Conflicts {
+		rejected := []string{conflict.Newer}
+		if e.ConflictPolicy == "both" {
+			rejected = append(rejected, conflict.Older)
+		}
+		for _, key := range rejected {
+			path, _, _ := strings.Cut(key, "#")
+			files = append(files, Quarantined{Path: path, Reason: conflict.String()})
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+// forget about rejected files that have been deleted, or every one in a deleted directory
+func (e *EnvoyProcessor) deleteQuarantined(path string) {
+	for key := range e.Quarantined {
+		if key == path || strings.HasPrefix(key, path+"/") {
+			delete(e.Quarantined, key)
 		}
 	}
-	// generate new snapshot from configuration and update the cache
-	return e.setSnapshot()
 }
 
 // called by ProcessChange, updates config of newly created/modified files
-func (e *EnvoyProcessor) processFile(msg watcher.Message) error {
-	var err error
+// nothing is changed if the file is rejected, so its last good config stays in place
+func (e *EnvoyProcessor) processFile(msg watcher.Message) (err error) {
 	var bags []usercfg.Bag
-	var config *univcfg.Config
+
+	// a bug turning a bad bag into a panic shouldn't take the whole proxy down
+	defer func() {
+		if r := recover(); r != nil {
+			// the stack is what makes the bug findable, the returned error only says which file hit it
+			fmt.Printf("panic processing %s: %+v\n%s", msg.Path, r, debug.Stack())
+			err = fmt.Errorf("%s: %+v", msg.Path, r)
+		}
+	}()
 
 	/* -------------------- MESSAGE CASES -------------------- */
-	// new file:     add it's configuration to our existing one
+	// new file:     delete any configuration the path already had, then add it's configuration to our existing one
 	// file changed: delete existing configuration of file, then re-add it
 	// file deleted: covered by Process
 	// file moved:   covered by Process
 	if msg.Operation == watcher.Delete || msg.Operation == watcher.Move {
 		return fmt.Errorf("operation can only be modify or create")
 	}
-	if msg.Operation == watcher.Modify {
-		delete(e.Configs, msg.Path)
+	if _, ok := overlayEnv(msg.Path); ok {
+		return fmt.Errorf("%s is an overlay, not a databag", msg.Path)
 	}
-	if bags, err = usercfg.ParseFile(msg.Path); err != nil {
+	overlay, err := usercfg.MergeOverlays(e.Overlays)
+	if err != nil {
 		return err
 	}
-	if config, err = parser.Parse(bags, e.ListenerInfo); err != nil {
+	if bags, err = usercfg.ParseFileWithOverlay(msg.Path, overlay); err != nil {
 		return err
 	}
-	e.Configs[msg.Path] = config
+	info, err := os.Stat(msg.Path)
+	if err != nil {
+		return fmt.Errorf("%s: %+v", msg.Path, err)
+	}
+
+	// each bag gets its own config, so parse them all before touching the existing ones
+	configs := make(map[string]*univcfg.Config)
+	for i, bag := range bags {
+		key := msg.Path
+		if len(bags) > 1 {
+			key = bagKey(msg.Path, bag, i)
+		}
+		if _, ok := configs[key]; ok {
+			return fmt.Errorf("duplicate bag id in %s: %s", msg.Path, bag.Id)
+		}
+		if configs[key], err = parser.Parse([]usercfg.Bag{bag}, e.ListenerInfo); err != nil {
+			return fmt.Errorf("%s: %+v", key, err)
+		}
+		// make sure envoy can be sent the bag too, otherwise it would break the snapshot for everyone
+		if err = e.checkConfig(configs[key]); err != nil {
+			return fmt.Errorf("%s: %+v", key, err)
+		}
+	}
+
+	// a file can be created over an old one (editors often save by renaming a new file into place)
+	// so the old configs always go, otherwise bags removed from the file would be kept
+	e.deleteConfigs(msg.Path)
+	e.BagIds[msg.Path] = nil
+	for _, bag := range bags {
+		e.BagIds[msg.Path] = append(e.BagIds[msg.Path], bag.Id)
+	}
+	keys := make([]string, 0, len(configs))
+	for key := range configs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		e.Configs[key] = configs[key]
+		// changing a file doesn't make its bags any newer
+		if _, ok := e.Added[key]; !ok {
+			e.Added[key] = info.ModTime()
+		}
+	}
 
 	return nil
 }
 
+// overlays live in an "overlays/<env>" folder anywhere in the databag directory, they're never bags themselves
+// files directly in "overlays" don't belong to any environment
+func overlayEnv(path string) (string, bool) {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i, part := range parts[:len(parts)-1] {
+		if part == "overlays" {
+			if i+2 < len(parts) {
+				return parts[i+1], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// read an overlay of our environment, the bags we already have need to be patched with it afterwards
+// overlays of other environments are skipped, returns true if the overlay was kept
+func (e *EnvoyProcessor) processOverlay(path string, env string) (bool, error) {
+	if e.Env == "" || env != e.Env {
+		return false, nil
+	}
+	overlay, err := usercfg.ParseOverlayFile(path)
+	if err != nil {
+		return false, err
+	}
+	e.Overlays[path] = overlay
+	return true, nil
+}
+
+// delete the overlays of a file, or every overlay in a directory
+// returns true if there were any, since the bags they patched have to be parsed again
+func (e *EnvoyProcessor) deleteOverlays(path string) bool {
+	deleted := false
+	for key := range e.Overlays {
+		if key == path || strings.HasPrefix(key, path+"/") {
+			delete(e.Overlays, key)
+			deleted = true
+		}
+	}
+	return deleted
+}
+
+// make sure every overlay of our environment patches a bag we know about
+func (e *EnvoyProcessor) checkOverlays() error {
+	ids := make(map[string]bool)
+	for _, bagIds := range e.BagIds {
+		for _, id := range bagIds {
+			ids[id] = true
+		}
+	}
+	var failures []string
+	for path, overlay := range e.Overlays {
+		for id := range overlay {
+			if !ids[id] {
+				failures = append(failures, fmt.Sprintf("%s: overlay for bag %s patches nothing, there's no bag with that id", path, id))
+			}
+		}
+	}
+	if len(failures) != 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// parse every bag file we know about again, after the overlays patching them changed
+// rejected bag files are tried again too, the new overlays might fix them
+func (e *EnvoyProcessor) reprocessBags() error {
+	paths := make(map[string]bool)
+	for key := range e.Configs {
+		paths[strings.SplitN(key, "#", 2)[0]] = true
+	}
+	for path := range e.Quarantined {
+		if _, ok := overlayEnv(path); !ok {
+			paths[path] = true
+		}
+	}
+	var sorted []string
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var failures []string
+	for _, path := range sorted {
+		if err := e.quarantine(path, e.processFile(watcher.Message{Operation: watcher.Modify, Path: path})); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) != 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// build the envoy resources of a single config, so problems show up on the file they came from
+func (e *EnvoyProcessor) checkConfig(config *univcfg.Config) error {
+	makeListeners(config, e.AddHttp)
+	makeClusters(config, e.RegionPriority)
+	makeEdsEndpoints(config, e.RegionPriority)
+	_, err := makeRoutes(config)
+	return err
+}
+
+// key for a bag in a file holding multiple bags, falls back to the bag's index if it has no id
+func bagKey(path string, bag usercfg.Bag, index int) string {
+	if bag.Id == "" {
+		return fmt.Sprintf("%s#%d", path, index)
+	}
+	return path + "#" + bag.Id
+}
+
+// delete the configs of every bag in a file, or every file in a directory
+func (e *EnvoyProcessor) deleteConfigs(path string) {
+	for key := range e.Configs {
+		if key == path || strings.HasPrefix(key, path+"#") || strings.HasPrefix(key, path+"/") {
+			delete(e.Configs, key)
+		}
+	}
+	for key := range e.BagIds {
+		if key == path || strings.HasPrefix(key, path+"/") {
+			delete(e.BagIds, key)
+		}
+	}
+}
+
 func (e *EnvoyProcessor) ClearConfig() {
 	e.Configs = make(map[string]*univcfg.Config)
+	e.BagIds = make(map[string][]string)
 	e.setSnapshot()
 }
 
@@ -144,7 +488,11 @@ func (e *EnvoyProcessor) ClearConfig() {
 func makeListeners(config *univcfg.Config, http bool) []types.Resource {
 	var resources []types.Resource
 
-	for _, l := range config.Listeners {
+	for _, zone := range univcfg.Zones {
+		l := config.Listeners[zone]
+		if l == nil {
+			continue
+		}
 		if http {
 			l := prxycfg.MakeHTTPListener(l)
 			resources = append(resources, l[0], l[1])
@@ -157,109 +505,189 @@ func makeListeners(config *univcfg.Config, http bool) []types.Resource {
 }
 
 // create resources array to hold all our cluster configurations
-func makeClusters(config *univcfg.Config) []types.Resource {
-	var https bool
+func makeClusters(config *univcfg.Config, priorities map[string]uint32) []types.Resource {
 	var resources []types.Resource
 
-	for name, cluster := range config.Clusters {
-		https = true
-		for _, endpoint := range config.Endpoints[name] {
-			if endpoint.Port != uint(443) {
-				https = false
-			}
+	for _, name := range clusterNames(config) {
+		cluster := config.Clusters[name]
+		// ip endpoints are sent separately over eds, hostnames have to be part of the cluster so envoy can resolve them
+		eds := univcfg.IPEndpoints(config.Endpoints[name])
+		c := prxycfg.MakeCluster(cluster, eds)
+		if !eds {
+			c.LoadAssignment = makeLoadAssignment(config, name, priorities)
 		}
-		c := prxycfg.MakeCluster(cluster, https)
-		c.LoadAssignment = makeEndpoints(config.Endpoints[name])
 		resources = append(resources, c)
 	}
 
 	return resources
 }
 
-// create resources array to hold all our route configurations
-func makeRoutes(config *univcfg.Config) []types.Resource {
-	// keep track of internal and external routes
-	var internalRoutes []*route.Route
-	var externalRoutes []*route.Route
-
+// create resources array to hold the endpoints of every cluster that gets them over eds
+// changing these doesn't touch the clusters, so envoy keeps its connections
+func makeEdsEndpoints(config *univcfg.Config, priorities map[string]uint32) []types.Resource {
 	var resources []types.Resource
 
-	// iterate through internal routes listed in internal listener
-	// add each route to our internal route array
-	for _, routeName := range config.Listeners["internal"].Routes {
-		r := config.Routes[routeName]
-		internalRoutes = append(internalRoutes, prxycfg.MakeRoute(r))
-	}
-	// iterate through internal routes listed in external listener
-	// add each route to our external route array
-	for _, routeName := range config.Listeners["external"].Routes {
-		r := config.Routes[routeName]
-		externalRoutes = append(externalRoutes, prxycfg.MakeRoute(r))
-	}
-	// add internal route configuration to resources array for internal routes
-	resources = append(resources, &route.RouteConfiguration{
-		Name: "internal-routes",
-		VirtualHosts: []*route.VirtualHost{{
-			Name:    "internal-routes",
-			Domains: []string{"*"},
-			Routes:  internalRoutes,
-		}},
-	})
-	// add internal route configuration to resources array for external routes
-	resources = append(resources, &route.RouteConfiguration{
-		Name: "external-routes",
-		VirtualHosts: []*route.VirtualHost{{
-			Name:    "external-routes",
-			Domains: []string{"*"},
-			Routes:  externalRoutes,
-		}},
-	})
+	for _, name := range clusterNames(config) {
+		if univcfg.IPEndpoints(config.Endpoints[name]) {
+			resources = append(resources, makeLoadAssignment(config, name, priorities))
+		}
+	}
 
 	return resources
 }
 
+// helper: names of every cluster in a config, sorted so resources always come out in the same order
+func clusterNames(config *univcfg.Config) []string {
+	names := make([]string, 0, len(config.Clusters))
+	for name := range config.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// endpoints of a single cluster, laid out the way its load balancing policy needs them
+func makeLoadAssignment(config *univcfg.Config, name string, priorities map[string]uint32) *endpoint.ClusterLoadAssignment {
+	assignment := makeEndpoints(config.Endpoints[name], priorities)
+	if config.Clusters[name].Policy == "first" {
+		fillInOrder(assignment)
+	}
+	return assignment
+}
+
+// create resources array to hold all our route configurations
+func makeRoutes(config *univcfg.Config) ([]types.Resource, error) {
+	var resources []types.Resource
+
+	// each listener gets its own route configuration, built from the routes listed in that listener
+	for _, zone := range univcfg.Zones {
+		l := config.Listeners[zone]
+		if l == nil {
+			continue
+		}
+
+		// envoy uses the first route that matches, so more specific routes have to come first
+		routeNames := append([]string(nil), l.Routes...)
+		univcfg.SortRoutes(routeNames, config.Routes)
+
+		var routes []*route.Route
+		for _, routeName := range routeNames {
+			r, err := prxycfg.MakeRoute(config.Routes[routeName], l)
+			if err != nil {
+				return nil, err
+			}
+			routes = append(routes, r)
+		}
+		resources = append(resources, &route.RouteConfiguration{
+			Name:         zone + "-routes",
+			VirtualHosts: []*route.VirtualHost{prxycfg.MakeVirtualHost(l, routes)},
+		})
+	}
+
+	return resources, nil
+}
+
+// give every endpoint its own priority, keeping region preference and then databag order
+// envoy sends everything to the first healthy endpoint, which is as close as it gets to haproxy's "first"
+func fillInOrder(assignment *endpoint.ClusterLoadAssignment) {
+	var localities []*endpoint.LocalityLbEndpoints
+	for _, locality := range assignment.Endpoints {
+		for _, lbEndpoint := range locality.LbEndpoints {
+			localities = append(localities, &endpoint.LocalityLbEndpoints{
+				Locality:    locality.Locality,
+				LbEndpoints: []*endpoint.LbEndpoint{lbEndpoint},
+				Priority:    uint32(len(localities)),
+			})
+		}
+	}
+	assignment.Endpoints = localities
+}
+
 // create resources array to hold all our endpoint configurations
-func makeEndpoints(edps []*univcfg.Endpoint) *endpoint.ClusterLoadAssignment {
-	// create endpoint array of all the endpoints that a single cluster maps to
-	var endpoints []*endpoint.LbEndpoint
+// endpoints are grouped into one locality per region, so envoy can fail over between regions
+func makeEndpoints(edps []*univcfg.Endpoint, priorities map[string]uint32) *endpoint.ClusterLoadAssignment {
+	// group the endpoints of a single cluster by their region
+	var regions []string
+	byRegion := make(map[string][]*endpoint.LbEndpoint)
 	for _, e := range edps {
-		endpoints = append(endpoints, prxycfg.MakeEndpoint(e))
+		if _, ok := byRegion[e.Region]; !ok {
+			regions = append(regions, e.Region)
+		}
+		byRegion[e.Region] = append(byRegion[e.Region], prxycfg.MakeEndpoint(e))
+	}
+
+	// envoy wants priorities to start at 0 with no gaps, so squash the configured ones down
+	var levels []uint32
+	for _, region := range regions {
+		levels = append(levels, priorities[region])
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+	compact := make(map[uint32]uint32)
+	for _, level := range levels {
+		if _, ok := compact[level]; !ok {
+			compact[level] = uint32(len(compact))
+		}
+	}
+
+	// most preferred regions first, ties broken by region name
+	sort.Slice(regions, func(i, j int) bool {
+		if priorities[regions[i]] != priorities[regions[j]] {
+			return priorities[regions[i]] < priorities[regions[j]]
+		}
+		return regions[i] < regions[j]
+	})
+
+	var localities []*endpoint.LocalityLbEndpoints
+	for _, region := range regions {
+		localities = append(localities, &endpoint.LocalityLbEndpoints{
+			Locality:    prxycfg.MakeLocality(region),
+			LbEndpoints: byRegion[region],
+			Priority:    compact[priorities[region]],
+		})
 	}
 	// add this new array of endpoints to our resources array
 	return &endpoint.ClusterLoadAssignment{
 		ClusterName: edps[0].ClusterName,
-		Endpoints: []*endpoint.LocalityLbEndpoints{{
-			LbEndpoints: endpoints,
-		}},
+		Endpoints:   localities,
 	}
 }
 
 // turns map of universal configs into snapshot, then sets the cache
+// the cache is left alone if the config didn't change, so envoy isn't sent anything
 func (e *EnvoyProcessor) setSnapshot() error {
-	var snapshot *cache.Snapshot
-	var err error
-
-	if len(e.Configs) == 0 {
-		snapshot, err = cache.NewSnapshot(e.newVersion(),
-			map[resource.Type][]types.Resource{
-				resource.ListenerType: nil,
-				resource.ClusterType:  nil,
-				resource.RouteType:    nil,
-				resource.EndpointType: nil,
-			})
-	} else {
-		cfg := univcfg.MergeConfigs(e.Configs)
+	resources := map[resource.Type][]types.Resource{
+		resource.ListenerType: nil,
+		resource.ClusterType:  nil,
+		resource.RouteType:    nil,
+		resource.EndpointType: nil,
+	}
+	if len(e.Configs) != 0 {
+		cfg := univcfg.MergeConfigs(e.acceptedConfigs())
 		// turn our universal configs into envoy proxy configs and add them to snapshot map
-		snapshot, err = cache.NewSnapshot(e.newVersion(),
-			map[resource.Type][]types.Resource{
-				resource.ListenerType: makeListeners(cfg, e.AddHttp),
-				resource.ClusterType:  makeClusters(cfg),
-				resource.RouteType:    makeRoutes(cfg),
-			})
+		resources[resource.ListenerType] = makeListeners(cfg, e.AddHttp)
+		resources[resource.ClusterType] = makeClusters(cfg, e.RegionPriority)
+		if e.ListenerInfo.RateLimitService != "" {
+			c, err := prxycfg.MakeRateLimitCluster(e.ListenerInfo.RateLimitService)
+			if err != nil {
+				return err
+			}
+			resources[resource.ClusterType] = append(resources[resource.ClusterType], c)
+		}
+		routes, err := makeRoutes(cfg)
+		if err != nil {
+			return fmt.Errorf("problem making routes: %+v", err)
+		}
+		resources[resource.RouteType] = routes
+		resources[resource.EndpointType] = makeEdsEndpoints(cfg, e.RegionPriority)
 	}
+
+	snapshot, version, err := newSnapshot(resources)
 	if err != nil {
 		return fmt.Errorf("problem generating snapshot: %+v", err)
 	}
+	if version == e.Version {
+		return nil
+	}
 	// make sure our cache is consistent with itself
 	if err = snapshot.Consistent(); err != nil {
 		return fmt.Errorf("snapshot inconsistency: \n\n%+v", err)
@@ -268,12 +696,88 @@ func (e *EnvoyProcessor) setSnapshot() error {
 	if err = e.Cache.SetSnapshot(context.Background(), "envoy-instance", snapshot); err != nil {
 		return fmt.Errorf("snapshot error: %+v\n\n%+v", snapshot, err)
 	}
+	e.Version = version
 
 	// return cache to the caller
 	return nil
 }
 
-func (e *EnvoyProcessor) newVersion() string {
-	e.Version++
-	return strconv.Itoa(int(e.Version))
+// build a snapshot whose versions are hashes of its resources
+// the same config always gets the same versions, even after a restart, so envoy doesn't reload what it already has
+// each resource type gets its own version, so envoy only reloads the types that changed
+// also returns the version of the snapshot as a whole, a hash of every type's version
+func newSnapshot(resources map[resource.Type][]types.Resource) (*cache.Snapshot, string, error) {
+	snapshot, err := cache.NewSnapshot("", resources)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hasher := sha256.New()
+	for _, typ := range []resource.Type{resource.ListenerType, resource.ClusterType, resource.RouteType, resource.EndpointType} {
+		version, err := resourcesVersion(resources[typ])
+		if err != nil {
+			return nil, "", err
+		}
+		snapshot.Resources[cache.GetResponseType(typ)].Version = version
+		fmt.Fprintf(hasher, "%s=%s\n", typ, version)
+	}
+	// per resource versions, used by delta xds
+	if err = snapshot.ConstructVersionMap(); err != nil {
+		return nil, "", err
+	}
+	return snapshot, hex.EncodeToString(hasher.Sum(nil))[:versionLength], nil
+}
+
+// helper: hash of a list of resources, sorted by name so the order they were made in doesn't matter
+func resourcesVersion(items []types.Resource) (string, error) {
+	sorted := append([]types.Resource(nil), items...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return cache.GetResourceName(sorted[i]) < cache.GetResourceName(sorted[j])
+	})
+
+	hasher := sha256.New()
+	for _, item := range sorted {
+		marshaled, err := cache.MarshalResource(item)
+		if err != nil {
+			return "", err
+		}
+		// length prefix, so resources can't run into each other
+		fmt.Fprintf(hasher, "%d:", len(marshaled))
+		hasher.Write(marshaled)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))[:versionLength], nil
+}
+
+// configs that don't claim a cluster or route another config already has
+// conflicts are printed instead of failing, so one bad file can't take every other api down with it
+func (e *EnvoyProcessor) acceptedConfigs() map[string]*univcfg.Config {
+	for key := range e.Added {
+		if _, ok := e.Configs[key]; !ok {
+			delete(e.Added, key)
+		}
+	}
+
+	// oldest first, configs whose files were modified at the same time go by key
+	// going by the files rather than the order we saw them in gives the same winner after a restart
+	keys := make([]string, 0, len(e.Configs))
+	for key := range e.Configs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !e.Added[keys[i]].Equal(e.Added[keys[j]]) {
+			return e.Added[keys[i]].Before(e.Added[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+
+	accepted, conflicts := univcfg.ResolveConflicts(e.Configs, keys, e.ConflictPolicy == "both")
+	for _, conflict := range conflicts {
+		if e.ConflictPolicy == "both" {
+			fmt.Printf("conflict: %s, ignoring both\n", conflict)
+		} else {
+			fmt.Printf("conflict: %s, ignoring %s\n", conflict, conflict.Newer)
+		}
+	}
+	e.Conflicts = conflicts
+	return accepted
 }
@@ -2,14 +2,33 @@ package processor
 
 import (
 	// "regexp"
+	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	// endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	corsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	localrlv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	rbacv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	headermutationv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/http/early_header_mutation/header_mutation/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	upstreamhttpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	prxycfg "github.com/fmgornick/dynamic-proxy/app/config/proxy"
 	univcfg "github.com/fmgornick/dynamic-proxy/app/config/universal"
 	watcher "github.com/fmgornick/dynamic-proxy/app/watcher"
 )
@@ -21,6 +40,31 @@ var listenerInfo univcfg.ListenerInfo = univcfg.ListenerInfo{
 	ExternalPort:       uint(2222),
 	InternalCommonName: "localhost",
 	ExternalCommonName: "localhost",
+	GroupsHeader:       "x-user-groups",
+	RateLimitService:   "ratelimit.address:8081",
+	RateLimitCounts:    []uint{5, 10},
+	UpstreamTls:        univcfg.UpstreamTls{CaFile: "ca.crt"},
+}
+
+// helper: add a cluster to a test config, failing the test if it's rejected
+func addCluster(t *testing.T, config *univcfg.Config, name string, policy string, healthcheck *univcfg.HealthCheck) *univcfg.Cluster {
+	c, err := config.AddCluster(name, policy, healthcheck)
+	assert.NoError(t, err, "cluster should be added")
+	return c
+}
+
+// helper: add a route to a test config, failing the test if it's rejected
+func addRoute(t *testing.T, config *univcfg.Config, clusterName string, path string, pathType string, rateLimit *univcfg.RateLimit) *univcfg.Route {
+	r, err := config.AddRoute(clusterName, path, pathType, rateLimit)
+	assert.NoError(t, err, "route should be added")
+	return r
+}
+
+// helper: route configurations of a test config, failing the test if they can't be made
+func routeConfigs(t *testing.T, config *univcfg.Config) []types.Resource {
+	resources, err := makeRoutes(config)
+	assert.NoError(t, err, "routes should be made")
+	return resources
 }
 
 func TestProcess(t *testing.T) {
@@ -86,15 +130,15 @@ func TestProcessFile(t *testing.T) {
 
 func TestMakeRoutes(t *testing.T) {
 	config := univcfg.NewConfig()
-	config.AddRoute("cluster1-in", "/cluster1/path", "exact")
-	config.AddRoute("cluster1-ie", "/cluster1/path", "exact")
-	config.AddRoute("cluster2-ex", "/cluster2/path", "starts_with")
+	addRoute(t, config, "cluster1-in", "/cluster1/path", "exact", nil)
+	addRoute(t, config, "cluster1-ie", "/cluster1/path", "exact", nil)
+	addRoute(t, config, "cluster2-ex", "/cluster2/path", "starts_with", nil)
 	config.AddListener("internal.address", "internal", 1111, "localhost")
 	config.AddListener("external.address", "external", 2222, "localhost")
 	config.Listeners["internal"].Routes = []string{"cluster1-in"}
 	config.Listeners["external"].Routes = []string{"cluster1-ie", "cluster2-ex"}
 
-	resources := makeRoutes(config)
+	resources := routeConfigs(t, config)
 
 	internalRoutes := resources[0].(*route.RouteConfiguration)
 	externalRoutes := resources[1].(*route.RouteConfiguration)
@@ -122,13 +166,13 @@ func TestMakeRoutes(t *testing.T) {
 
 func TestMakeEndpoints(t *testing.T) {
 	config := univcfg.NewConfig()
-	config.AddCluster("cluster1-in", "round_robin", nil)
-	config.AddCluster("cluster2-in", "round_robin", nil)
+	addCluster(t, config, "cluster1-in", "round_robin", nil)
+	addCluster(t, config, "cluster2-in", "round_robin", nil)
 	config.AddEndpoint("address1", "cluster1-in", 1111, "", 1)
 	config.AddEndpoint("address2", "cluster2-in", 2222, "", 2)
 	config.AddEndpoint("address3", "cluster1-in", 3333, "", 4)
 
-	resources := makeClusters(config)
+	resources := makeClusters(config, nil)
 	loadAssignment1 := resources[0].(*clusterv3.Cluster).LoadAssignment
 	loadAssignment2 := resources[1].(*clusterv3.Cluster).LoadAssignment
 
@@ -152,3 +196,1141 @@ func TestMakeEndpoints(t *testing.T) {
 		s.ReplaceAllString(loadAssignment2.Endpoints[0].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress().String(), " "),
 		"should have matching address and port")
 }
+
+func TestMakeRoutesRateLimit(t *testing.T) {
+	config := univcfg.NewConfig()
+	addRoute(t, config, "cluster1-in", "/cluster1/path", "exact", &univcfg.RateLimit{Count: 10, Field: "client-ip"})
+	addRoute(t, config, "cluster2-in", "/cluster2/path", "starts_with", nil)
+	addRoute(t, config, "cluster3-in", "/cluster3/path", "starts_with", &univcfg.RateLimit{Count: 5})
+	addRoute(t, config, "cluster4-in", "/cluster4/path", "starts_with", &univcfg.RateLimit{Count: 20, Field: "api-key"})
+	addRoute(t, config, "cluster5-in", "/cluster5/path", "starts_with", &univcfg.RateLimit{Count: 30, Field: "client-ip"})
+	config.Routes["cluster5-in"].Direct = &univcfg.DirectResponse{Status: 503, Body: "down"}
+	config.AddListener("internal.address", "internal", 1111, "localhost")
+	config.AddListener("external.address", "external", 2222, "localhost")
+	config.Listeners["internal"].Routes = []string{"cluster1-in", "cluster2-in", "cluster3-in", "cluster4-in", "cluster5-in"}
+
+	routes := make(map[string]*route.Route)
+	for _, r := range routeConfigs(t, config)[0].(*route.RouteConfiguration).VirtualHosts[0].Routes {
+		routes[r.Name] = r
+	}
+
+	// a bucket shared by every client would let one client use up everyone's limit
+	perClient := routes["cluster1-in"]
+	assert.NotContains(t, perClient.TypedPerFilterConfig, "envoy.filters.http.local_ratelimit", "per client limit shouldn't use the shared local bucket")
+	actions := perClient.GetRoute().RateLimits[0].Actions
+	assert.Equal(t, 3, len(actions), "descriptor should be limit, route and client")
+	assert.Equal(t, "limit", actions[0].GetGenericKey().DescriptorKey, "descriptor should carry the limit")
+	assert.Equal(t, "10", actions[0].GetGenericKey().DescriptorValue, "descriptor should carry the limit")
+	assert.Equal(t, "route", actions[1].GetGenericKey().DescriptorKey, "descriptor should carry the route")
+	assert.Equal(t, "cluster1-in", actions[1].GetGenericKey().DescriptorValue, "each route should get its own buckets")
+	assert.IsType(t, &route.RateLimit_Action_RemoteAddress_{}, actions[2].ActionSpecifier, "each client ip should get its own bucket")
+
+	perKey := routes["cluster4-in"].GetRoute().RateLimits[0].Actions
+	assert.Equal(t, "x-api-key", perKey[2].GetRequestHeaders().HeaderName, "each api key should get its own bucket")
+	assert.Equal(t, "api_key", perKey[2].GetRequestHeaders().DescriptorKey, "each api key should get its own bucket")
+	// requests without a key don't get to skip the limit
+	withoutKey := routes["cluster4-in"].GetRoute().RateLimits[1].Actions
+	assert.Equal(t, 4, len(withoutKey), "descriptor should be limit, route, missing key and client")
+	assert.Equal(t, "api_key", withoutKey[2].GetHeaderValueMatch().DescriptorKey, "missing key should have its own descriptor")
+	assert.Equal(t, "none", withoutKey[2].GetHeaderValueMatch().DescriptorValue, "missing key should have its own descriptor")
+	assert.False(t, withoutKey[2].GetHeaderValueMatch().ExpectMatch.GetValue(), "descriptor should only be sent without the header")
+	assert.IsType(t, &route.RateLimit_Action_RemoteAddress_{}, withoutKey[3].ActionSpecifier, "requests without a key should be limited per client ip")
+
+	wholeRoute := routes["cluster3-in"]
+	assert.Contains(t, wholeRoute.TypedPerFilterConfig, "envoy.filters.http.local_ratelimit", "whole route limit should be local")
+	assert.Empty(t, wholeRoute.GetRoute().RateLimits, "whole route limit shouldn't go to the rate limit service")
+	local := &localrlv3.LocalRateLimit{}
+	wholeRoute.TypedPerFilterConfig["envoy.filters.http.local_ratelimit"].UnmarshalTo(local)
+	assert.Equal(t, uint32(5), local.TokenBucket.MaxTokens, "whole route should share one bucket of its limit")
+	assert.Empty(t, local.Descriptors, "local limit shouldn't pretend to be per client")
+
+	// direct responses never reach the rate limit service, keep limiting them locally
+	direct := routes["cluster5-in"]
+	assert.NotNil(t, direct.GetDirectResponse(), "route should answer requests itself")
+	assert.Contains(t, direct.TypedPerFilterConfig, "envoy.filters.http.local_ratelimit", "direct response should keep a local limit")
+
+	assert.Empty(t, routes["cluster2-in"].TypedPerFilterConfig, "should not have rate limit config")
+	assert.Empty(t, routes["cluster2-in"].GetRoute().RateLimits, "should not have rate limit actions")
+
+	// listeners only call the rate limit service if there is one
+	config.Listeners["internal"].RateLimits = true
+	filters := httpFilterNames(t, prxycfg.MakeHTTPSListener(config.Listeners["internal"], false))
+	assert.Contains(t, filters, "envoy.filters.http.ratelimit", "listener should call the rate limit service")
+	assert.Equal(t, "envoy.filters.http.router", filters[len(filters)-1], "router should stay the last filter")
+	assert.NotContains(t, httpFilterNames(t, prxycfg.MakeHTTPSListener(config.Listeners["external"], false)), "envoy.filters.http.ratelimit",
+		"listener without a rate limit service shouldn't call it")
+
+	c, err := prxycfg.MakeRateLimitCluster("ratelimit.address:8081")
+	assert.NoError(t, err, "rate limit cluster should be made")
+	assert.Equal(t, "ratelimit_service", c.Name, "rate limit filter should point at the cluster")
+	_, err = prxycfg.MakeRateLimitCluster("ratelimit.address")
+	assert.Error(t, err, "rate limit service needs a port")
+}
+
+// helper: names of the http filters of a listener, in order
+func httpFilterNames(t *testing.T, l *listenerv3.Listener) []string {
+	manager := &hcmv3.HttpConnectionManager{}
+	err := l.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(manager)
+	assert.NoError(t, err, "listener should hold a connection manager")
+	var names []string
+	for _, filter := range manager.HttpFilters {
+		names = append(names, filter.Name)
+	}
+	return names
+}
+
+func TestMakeRoutesGroups(t *testing.T) {
+	config := univcfg.NewConfig()
+	addRoute(t, config, "cluster1-ie", "/cluster1/path", "exact", nil).Groups = []string{"CN=APP-API-Group"}
+	config.AddListener("internal.address", "internal", 1111, "localhost").GroupsHeader = "x-user-groups"
+	config.AddListener("external.address", "external", 2222, "localhost")
+	config.Listeners["internal"].Routes = []string{"cluster1-ie"}
+	config.Listeners["external"].Routes = []string{"cluster1-ie"}
+
+	resources := routeConfigs(t, config)
+	internalRoute := resources[0].(*route.RouteConfiguration).VirtualHosts[0].Routes[0]
+	externalRoute := resources[1].(*route.RouteConfiguration).VirtualHosts[0].Routes[0]
+
+	assert.Contains(t, internalRoute.TypedPerFilterConfig, "envoy.filters.http.rbac", "should have rbac config")
+	assert.NotContains(t, externalRoute.TypedPerFilterConfig, "envoy.filters.http.rbac",
+		"should not have rbac config if listener has no groups header")
+
+	// groups are whole elements of the header's list, not substrings of it
+	rbac := &rbacv3.RBACPerRoute{}
+	internalRoute.TypedPerFilterConfig["envoy.filters.http.rbac"].UnmarshalTo(rbac)
+	principal := rbac.Rbac.Rules.Policies["groups"].Principals[0].GetOrIds().Ids[0].GetHeader()
+	assert.Equal(t, "x-user-groups", principal.Name, "should check the groups header")
+	pattern := regexp.MustCompile(principal.GetStringMatch().GetSafeRegex().Regex)
+	assert.True(t, pattern.MatchString("CN=APP-API-Group"), "group on its own should match")
+	assert.True(t, pattern.MatchString("CN=Other,OU=Groups; cn=app-api-group"), "group anywhere in the list should match, ignoring case")
+	assert.False(t, pattern.MatchString("CN=APP-API-Group-Test"), "group with a longer name shouldn't match")
+	assert.False(t, pattern.MatchString("CN=Other,CN=APP-API-Group"), "group inside another element shouldn't match")
+
+	// the groups header is removed from requests that don't come from a trusted hop
+	l := config.Listeners["internal"]
+	chains := prxycfg.MakeHTTPSListener(l, false).FilterChains
+	assert.Equal(t, 1, len(chains), "without trusted hops every request goes through one chain")
+	assert.Equal(t, []string{"x-user-groups"}, removedHeaders(t, chains[0]), "groups header should be removed")
+
+	l.GroupsTrustedCidrs = []string{"10.0.0.0/8"}
+	chains = prxycfg.MakeHTTPSListener(l, false).FilterChains
+	assert.Equal(t, 2, len(chains), "trusted hops should get their own chain")
+	assert.Equal(t, "10.0.0.0", chains[0].FilterChainMatch.DirectSourcePrefixRanges[0].AddressPrefix, "trusted chain should match the trusted hops")
+	assert.Equal(t, uint32(8), chains[0].FilterChainMatch.DirectSourcePrefixRanges[0].PrefixLen.GetValue(), "trusted chain should match the trusted hops")
+	assert.Empty(t, removedHeaders(t, chains[0]), "trusted hops should keep the groups header")
+	assert.Nil(t, chains[1].FilterChainMatch, "everyone else should fall through to the default chain")
+	assert.Equal(t, []string{"x-user-groups"}, removedHeaders(t, chains[1]), "everyone else should have the groups header removed")
+
+	chains = prxycfg.MakeHTTPSListener(config.Listeners["external"], false).FilterChains
+	assert.Empty(t, removedHeaders(t, chains[0]), "nothing to remove without a groups header")
+}
+
+// helper: headers a filter chain removes before routing
+func removedHeaders(t *testing.T, chain *listenerv3.FilterChain) []string {
+	manager := &hcmv3.HttpConnectionManager{}
+	err := chain.Filters[0].GetTypedConfig().UnmarshalTo(manager)
+	assert.NoError(t, err, "filter chain should hold a connection manager")
+	var removed []string
+	for _, extension := range manager.EarlyHeaderMutationExtensions {
+		mutation := &headermutationv3.HeaderMutation{}
+		extension.TypedConfig.UnmarshalTo(mutation)
+		for _, m := range mutation.Mutations {
+			removed = append(removed, m.GetRemove())
+		}
+	}
+	return removed
+}
+
+func TestParseRegions(t *testing.T) {
+	regions, err := ParseRegions("ttc, ttce ,global")
+	assert.NoError(t, err, "region list should parse")
+	assert.Equal(t, []string{"ttc", "ttce", "global"}, regions, "spaces around regions should be ignored")
+	assert.Equal(t, uint32(1), RegionPriorities(regions)["ttce"], "region after a space should keep its priority")
+
+	_, err = ParseRegions("ttc,,ttce")
+	assert.Error(t, err, "empty region should be rejected")
+	_, err = ParseRegions("ttc, ")
+	assert.Error(t, err, "trailing comma should be rejected")
+}
+
+func TestMakeEndpointsRegions(t *testing.T) {
+	config := univcfg.NewConfig()
+	addCluster(t, config, "cluster1-in", "round_robin", nil)
+	config.AddEndpoint("address1", "cluster1-in", 1111, "ttce", 1)
+	config.AddEndpoint("address2", "cluster1-in", 2222, "global", 1)
+	config.AddEndpoint("address3", "cluster1-in", 3333, "ttc", 1)
+	config.AddEndpoint("address4", "cluster1-in", 4444, "ttce", 1)
+
+	loadAssignment := makeEndpoints(config.Endpoints["cluster1-in"], RegionPriorities([]string{"ttc", "ttce"}))
+
+	assert.Equal(t, 3, len(loadAssignment.Endpoints), "should have one locality per region")
+	assert.Equal(t, "global", loadAssignment.Endpoints[0].Locality.Region, "unlisted region should share top priority")
+	assert.Equal(t, uint32(0), loadAssignment.Endpoints[0].Priority, "unlisted region should share top priority")
+	assert.Equal(t, "ttc", loadAssignment.Endpoints[1].Locality.Region, "local region should be preferred")
+	assert.Equal(t, uint32(0), loadAssignment.Endpoints[1].Priority, "local region should be preferred")
+	assert.Equal(t, "ttce", loadAssignment.Endpoints[2].Locality.Region, "other region should be failover")
+	assert.Equal(t, uint32(1), loadAssignment.Endpoints[2].Priority, "other region should be failover")
+	assert.Equal(t, 2, len(loadAssignment.Endpoints[2].LbEndpoints), "both ttce endpoints should share a locality")
+
+	loadAssignment = makeEndpoints(config.Endpoints["cluster1-in"][:1], RegionPriorities([]string{"ttc", "ttce"}))
+	assert.Equal(t, uint32(0), loadAssignment.Endpoints[0].Priority, "priorities should not have gaps")
+}
+
+func TestMakeClustersHealthCheck(t *testing.T) {
+	config := univcfg.NewConfig()
+	addCluster(t, config, "cluster1-in", "round_robin", &univcfg.HealthCheck{
+		ExpectedStatuses: []univcfg.StatusRange{{Start: 200, End: 299}},
+		Healthy:          2,
+		Interval:         500 * time.Millisecond,
+		Method:           "HEAD",
+		Path:             "/health",
+		Port:             8080,
+		Timeout:          time.Second,
+		Type:             "http",
+		Unhealthy:        3,
+		Version:          "HTTP/2",
+	})
+	config.AddEndpoint("address1", "cluster1-in", 1111, "", 0).HealthCheckPort = 8080
+
+	c := makeClusters(config, nil)[0].(*clusterv3.Cluster)
+	hc := c.HealthChecks[0]
+	http := hc.GetHttpHealthCheck()
+
+	assert.Equal(t, 500*time.Millisecond, hc.Interval.AsDuration(), "interval should match")
+	assert.Equal(t, time.Second, hc.Timeout.AsDuration(), "timeout should match")
+	assert.Equal(t, core.RequestMethod_HEAD, http.Method, "method should match")
+	assert.Equal(t, typev3.CodecClientType_HTTP2, http.CodecClientType, "should health check over HTTP/2")
+	assert.Equal(t, int64(300), http.ExpectedStatuses[0].End, "range end should be exclusive")
+	assert.Equal(t, uint32(8080),
+		c.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().HealthCheckConfig.PortValue,
+		"endpoint should have health check port")
+}
+
+func TestProcessMultiBagFiles(t *testing.T) {
+	e := NewProcessor("node", false, listenerInfo)
+	err := e.Process(watcher.Message{
+		Operation: watcher.Create,
+		Path:      "test_folder/multi",
+	})
+	assert.NoError(t, err, "function call should not produce error")
+
+	assert.Equal(t, 4, len(e.Configs), "each bag should get its own config")
+	assert.NotNil(t, e.Configs["test_folder/multi/array.json#team-api1"].Routes["team-api1-in"], "array bag should be parsed")
+	assert.NotNil(t, e.Configs["test_folder/multi/array.json#team-api2"].Routes["team-api2-ex"], "array bag should be parsed")
+	assert.NotNil(t, e.Configs["test_folder/multi/stream.json#team-api3"].Routes["team-api3-in"], "streamed bag should be parsed")
+	assert.NotNil(t, e.Configs["test_folder/multi/stream.json#team-api4"].Routes["team-api4-in"], "streamed bag should be parsed")
+
+	err = e.Process(watcher.Message{
+		Operation: watcher.Delete,
+		Path:      "test_folder/multi/array.json",
+	})
+	assert.NoError(t, err, "function call should not produce error")
+	assert.Equal(t, 2, len(e.Configs), "deleting a file should remove all of its bags")
+	assert.Nil(t, e.Configs["test_folder/multi/array.json#team-api1"], "bag should be removed with its file")
+}
+
+func TestProcessFileFormats(t *testing.T) {
+	e := NewProcessor("node", false, listenerInfo)
+	err := e.Process(watcher.Message{
+		Operation: watcher.Create,
+		Path:      "test_folder/formats",
+	})
+	assert.NoError(t, err, "function call should not produce error")
+
+	yamlConfig := e.Configs["test_folder/formats/bags.yaml#yaml-v1"]
+	assert.Equal(t, "/yaml/v1", yamlConfig.Routes["yaml-v1-in"].Path, "yaml bag should be parsed")
+	assert.Equal(t, uint(10), yamlConfig.Routes["yaml-v1-in"].RateLimit.Count, "yaml field names should match json")
+	assert.Equal(t, "yaml2.address", e.Configs["test_folder/formats/bags.yaml#yaml-v2"].Endpoints["yaml-v2-ex"][0].Address,
+		"every yaml document should be parsed")
+
+	tomlConfig := e.Configs["test_folder/formats/bag.toml"]
+	assert.Equal(t, "least_request", tomlConfig.Clusters["toml-v1-in"].Policy, "toml bag should be parsed")
+	assert.Equal(t, uint(3333), tomlConfig.Endpoints["toml-v1-in"][0].Port, "toml bag should be parsed")
+
+	dir := t.TempDir()
+	badJson := filepath.Join(dir, "bad.json")
+	os.WriteFile(badJson, []byte("{\n  \"id\": \"bad\",\n  \"backends\": 5\n}\n"), 0644)
+	badYaml := filepath.Join(dir, "bad.yaml")
+	os.WriteFile(badYaml, []byte("id: bad\nbackends:\n  - servers:\n      endpoints: nope\n"), 0644)
+
+	err = e.processFile(watcher.Message{Operation: watcher.Create, Path: badJson})
+	assert.ErrorContains(t, err, badJson+":3: backends:", "json error should point at file and line")
+	err = e.processFile(watcher.Message{Operation: watcher.Create, Path: badYaml})
+	assert.ErrorContains(t, err, badYaml+":4: backends[0].servers.endpoints:", "yaml error should point at file and line")
+}
+
+func TestProcessFileRecreated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bags.json")
+	os.WriteFile(path, []byte(`[
+  {"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "cars.address"}]}}]},
+  {"id": "trucks-v1", "backends": [{"servers": {"endpoints": [{"address": "trucks.address"}]}}]}
+]`), 0644)
+
+	e := NewProcessor("node", false, listenerInfo)
+	err := e.Process(watcher.Message{Operation: watcher.Create, Path: path})
+	assert.NoError(t, err, "function call should not produce error")
+	assert.Contains(t, e.Configs, path+"#trucks-v1", "every bag should be added")
+
+	// saving by renaming a new file into place shows up as a create, not a modify
+	os.WriteFile(path, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "cars.address"}]}}]}`), 0644)
+	err = e.Process(watcher.Message{Operation: watcher.Create, Path: path})
+	assert.NoError(t, err, "function call should not produce error")
+	assert.Equal(t, []string{path}, configKeys(e), "bags removed from the file should be gone")
+	snapshot, _ := e.Cache.GetSnapshot("envoy-instance")
+	assert.NotContains(t, snapshot.GetResources(resource.ClusterType), "trucks-v1-ie", "removed bag shouldn't be served")
+	assert.Contains(t, snapshot.GetResources(resource.ClusterType), "cars-v1-ie", "remaining bag should be served")
+}
+
+// helper: sorted keys of the processor's configs
+func configKeys(e *EnvoyProcessor) []string {
+	keys := make([]string, 0, len(e.Configs))
+	for key := range e.Configs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestProcessFileValidation(t *testing.T) {
+	e := NewProcessor("node", false, listenerInfo)
+
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`{
+  "id": "bad",
+  "availabilty": ["internal"],
+  "backends": [
+    {"servers": {"endpoints": [{"address": "first.address"}]}},
+    {"servers": {"endpoints": [{"address": "second.address", "port": "443"}]}},
+    {
+      "match": {
+        "path": {"pattern": "/bad/path", "type": "prefix"}
+      },
+      "servers": {"endpoints": [{"address": "third.address"}]}
+    }
+  ]
+}
+`), 0644)
+
+	err := e.processFile(watcher.Message{Operation: watcher.Create, Path: bad})
+	assert.Error(t, err, "invalid databag should produce an error")
+	assert.Contains(t, err.Error(), bad+":3: availabilty: unknown field", "should report unknown keys at the key")
+	assert.Contains(t, err.Error(), bad+":6: backends[1].servers.endpoints[0].port: expected integer, but got string",
+		"should report wrong types")
+	assert.Contains(t, err.Error(), bad+":9: backends[2].match.path.type: value must be one of",
+		"should report invalid values")
+	assert.Empty(t, e.Configs, "invalid databag should not make it into our configs")
+
+	// toml files point at their lines too, bags split by [[bags]] included
+	badToml := filepath.Join(dir, "bad.toml")
+	os.WriteFile(badToml, []byte(`# a good bag first
+[[bags]]
+id = "good"
+availability = ["internal"]
+
+[[bags.backends]]
+servers = { endpoints = [{ address = "good.address" }] }
+
+[[bags]]
+id = "bad"
+availabilty = ["internal"]
+
+[[bags.backends]]
+[bags.backends.servers]
+endpoints = [
+  { address = "first.address" },
+  { address = "second.address", port = "443" },
+]
+
+[[bags.backends]]
+servers.endpoints = [{ address = "third.address" }]
+match.path = { pattern = "/bad/path", type = "prefix" }
+`), 0644)
+
+	err = e.processFile(watcher.Message{Operation: watcher.Create, Path: badToml})
+	assert.Error(t, err, "invalid toml databag should produce an error")
+	assert.Contains(t, err.Error(), badToml+":11: availabilty: unknown field", "should report unknown toml keys at the key")
+	assert.Contains(t, err.Error(), badToml+":17: backends[0].servers.endpoints[1].port: expected integer, but got string",
+		"should report wrong types at their array element")
+	assert.Contains(t, err.Error(), badToml+":22: backends[1].match.path.type: value must be one of",
+		"should report invalid values in dotted keys and inline tables")
+	assert.Empty(t, e.Configs, "invalid toml databag should not make it into our configs")
+
+	// every databag we ship should pass validation
+	err = e.Process(watcher.Message{
+		Operation: watcher.Create,
+		Path:      "../../databags",
+	})
+	assert.NoError(t, err, "shipped databags should be valid")
+}
+
+func TestMakeRoutesMatchConditions(t *testing.T) {
+	config := univcfg.NewConfig()
+	addRoute(t, config, "cluster1-in", "/cluster1", "starts_with", nil)
+	writes := addRoute(t, config, "cluster1-0badf00d-in", "/cluster1", "starts_with", nil)
+	writes.Methods = []string{"POST", "PUT"}
+	writes.Headers = []univcfg.HeaderMatch{{Name: "accept-version", Type: "prefix", Value: "2", Invert: true}}
+	writes.QueryParams = []univcfg.QueryParamMatch{{Name: "debug", Type: "present"}}
+	config.AddListener("internal.address", "internal", 1111, "localhost")
+	config.Listeners["internal"].Routes = []string{"cluster1-in", "cluster1-0badf00d-in"}
+
+	resources := routeConfigs(t, config)
+	routes := resources[0].(*route.RouteConfiguration).VirtualHosts[0].Routes
+
+	assert.Equal(t, "cluster1-0badf00d-in", routes[0].Name, "route with conditions should come first")
+	assert.Equal(t, "accept-version", routes[0].Match.Headers[0].Name, "header name should match")
+	assert.True(t, routes[0].Match.Headers[0].InvertMatch, "header match should be inverted")
+	assert.Equal(t, "2", routes[0].Match.Headers[0].GetStringMatch().GetPrefix(), "header should be prefix matched")
+	assert.Equal(t, ":method", routes[0].Match.Headers[1].Name, "methods should match on method header")
+	assert.Equal(t, "^(POST|PUT)$", routes[0].Match.Headers[1].GetStringMatch().GetSafeRegex().Regex, "methods should be or'd")
+	assert.True(t, routes[0].Match.QueryParameters[0].GetPresentMatch(), "query param should be present matched")
+	assert.Empty(t, routes[1].Match.Headers, "plain route should only match path")
+}
+
+func TestMakeRoutesRewrite(t *testing.T) {
+	config := univcfg.NewConfig()
+	addRoute(t, config, "strip-in", "/strip", "starts_with", nil).PrefixRewrite = "/"
+	addRoute(t, config, "base-in", "/base", "starts_with", nil).PrefixRewrite = "/api"
+	addRoute(t, config, "regex-in", "/regex/.*", "regex", nil).RegexRewrite = &univcfg.RegexRewrite{Pattern: "^/regex/(.*)$", Substitution: "/\\1"}
+	config.AddListener("internal.address", "internal", 1111, "localhost")
+	config.Listeners["internal"].Routes = []string{"base-in", "regex-in", "strip-in"}
+
+	resources := routeConfigs(t, config)
+	routes := map[string]*route.RouteAction{}
+	for _, r := range resources[0].(*route.RouteConfiguration).VirtualHosts[0].Routes {
+		routes[r.Name] = r.GetRoute()
+	}
+
+	assert.Equal(t, "^/strip/*", routes["strip-in"].RegexRewrite.Pattern.Regex, "stripping a prefix should also strip the slashes after it")
+	assert.Equal(t, "/", routes["strip-in"].RegexRewrite.Substitution, "stripped prefix should be swapped for a slash")
+	assert.Equal(t, "/api", routes["base-in"].PrefixRewrite, "prefix rewrite should carry through")
+	assert.Equal(t, "^/regex/(.*)$", routes["regex-in"].RegexRewrite.Pattern.Regex, "regex rewrite pattern should carry through")
+	assert.Equal(t, "/\\1", routes["regex-in"].RegexRewrite.Substitution, "regex rewrite substitution should carry through")
+}
+
+func TestMakeTimeoutsAndRetries(t *testing.T) {
+	config := univcfg.NewConfig()
+	addCluster(t, config, "reports-in", "round_robin", nil).ConnectTimeout = 2 * time.Second
+	addCluster(t, config, "legacy-in", "round_robin", nil)
+	config.AddEndpoint("address1", "reports-in", 1111, "", 0)
+	config.AddEndpoint("address2", "legacy-in", 2222, "", 0)
+	reports := addRoute(t, config, "reports-in", "/reports", "starts_with", nil)
+	reports.Timeout = 5 * time.Minute
+	reports.IdleTimeout = time.Minute
+	addRoute(t, config, "legacy-in", "/legacy", "starts_with", nil).Retry = &univcfg.RetryPolicy{
+		Count:         3,
+		On:            []string{"5xx", "reset"},
+		PerTryTimeout: 2 * time.Second,
+	}
+	config.AddListener("internal.address", "internal", 1111, "localhost")
+	config.Listeners["internal"].Routes = []string{"legacy-in", "reports-in"}
+
+	clusters := map[string]*clusterv3.Cluster{}
+	for _, c := range makeClusters(config, nil) {
+		clusters[c.(*clusterv3.Cluster).Name] = c.(*clusterv3.Cluster)
+	}
+	assert.Equal(t, 2*time.Second, clusters["reports-in"].ConnectTimeout.AsDuration(), "connect timeout should match")
+	assert.Equal(t, 5*time.Second, clusters["legacy-in"].ConnectTimeout.AsDuration(), "connect timeout should default to 5s")
+
+	routes := map[string]*route.RouteAction{}
+	for _, r := range routeConfigs(t, config)[0].(*route.RouteConfiguration).VirtualHosts[0].Routes {
+		routes[r.Name] = r.GetRoute()
+	}
+	assert.Equal(t, 5*time.Minute, routes["reports-in"].Timeout.AsDuration(), "request timeout should match")
+	assert.Equal(t, time.Minute, routes["reports-in"].IdleTimeout.AsDuration(), "idle timeout should match")
+	assert.Nil(t, routes["reports-in"].RetryPolicy, "route without retries shouldn't have a retry policy")
+	assert.Nil(t, routes["legacy-in"].Timeout, "route without a timeout should use envoy's default")
+	assert.Equal(t, "5xx,reset", routes["legacy-in"].RetryPolicy.RetryOn, "retry conditions should match")
+	assert.Equal(t, uint32(3), routes["legacy-in"].RetryPolicy.NumRetries.GetValue(), "retry count should match")
+	assert.Equal(t, 2*time.Second, routes["legacy-in"].RetryPolicy.PerTryTimeout.AsDuration(), "per try timeout should match")
+}
+
+func TestMakeRoutesSplits(t *testing.T) {
+	config := univcfg.NewConfig()
+	addRoute(t, config, "cars-v3-in", "/cars/v3", "starts_with", nil).Splits = []univcfg.WeightedCluster{
+		{Name: "cars-v3-in", Weight: 95},
+		{Name: "cars-v3+canary-in", Weight: 5},
+	}
+	config.AddListener("internal.address", "internal", 1111, "localhost")
+	config.Listeners["internal"].Routes = []string{"cars-v3-in"}
+
+	action := routeConfigs(t, config)[0].(*route.RouteConfiguration).VirtualHosts[0].Routes[0].GetRoute()
+	clusters := action.GetWeightedClusters().Clusters
+
+	assert.Equal(t, "", action.GetCluster(), "split route shouldn't send everything to one cluster")
+	assert.Equal(t, "cars-v3-in", clusters[0].Name, "main cluster should come first")
+	assert.Equal(t, uint32(95), clusters[0].Weight.GetValue(), "main cluster weight should match")
+	assert.Equal(t, "cars-v3+canary-in", clusters[1].Name, "split cluster should come second")
+	assert.Equal(t, uint32(5), clusters[1].Weight.GetValue(), "split cluster weight should match")
+}
+
+func TestMakeRoutesHeaders(t *testing.T) {
+	config := univcfg.NewConfig()
+	addRoute(t, config, "cars-ex", "/cars", "starts_with", nil).HeaderRules = univcfg.HeaderRules{
+		Request: univcfg.HeaderActions{
+			Add: []univcfg.HeaderValue{{Name: "x-team", Value: "cars"}},
+			Set: []univcfg.HeaderValue{{Name: "x-forwarded-prefix", Value: "/cars"}},
+		},
+		Response: univcfg.HeaderActions{Remove: []string{"server"}},
+	}
+	l := config.AddListener("external.address", "external", 2222, "localhost")
+	l.Routes = []string{"cars-ex"}
+	l.HeaderRules = univcfg.HeaderRules{
+		Request:  univcfg.HeaderActions{Remove: []string{"x-debug"}},
+		Response: univcfg.HeaderActions{Set: []univcfg.HeaderValue{{Name: "x-frame-options", Value: "DENY"}}},
+	}
+
+	vh := routeConfigs(t, config)[0].(*route.RouteConfiguration).VirtualHosts[0]
+	rt := vh.Routes[0]
+
+	assert.Equal(t, "x-team", rt.RequestHeadersToAdd[0].Header.Key, "added header should come first")
+	assert.Equal(t, core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD, rt.RequestHeadersToAdd[0].AppendAction, "added header should append")
+	assert.Equal(t, "/cars", rt.RequestHeadersToAdd[1].Header.Value, "set header value should match")
+	assert.Equal(t, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD, rt.RequestHeadersToAdd[1].AppendAction, "set header should overwrite")
+	assert.Equal(t, []string{"server"}, rt.ResponseHeadersToRemove, "route should remove response header")
+	assert.Equal(t, []string{"x-debug"}, vh.RequestHeadersToRemove, "listener should remove request header")
+	assert.Equal(t, "x-frame-options", vh.ResponseHeadersToAdd[0].Header.Key, "listener should set response header")
+}
+
+func TestMakeRoutesCors(t *testing.T) {
+	config := univcfg.NewConfig()
+	addRoute(t, config, "cars-ex", "/cars", "starts_with", nil).Cors = &univcfg.CorsPolicy{
+		AllowCredentials: true,
+		AllowHeaders:     []string{"authorization", "content-type"},
+		AllowMethods:     []string{"GET", "POST"},
+		AllowOrigins:     []univcfg.CorsOrigin{{Type: "exact", Value: "https://www.target.com"}, {Type: "regex", Value: `https://.*\.target\.com`}},
+		ExposeHeaders:    []string{"x-request-id"},
+		MaxAge:           10 * time.Minute,
+	}
+	addRoute(t, config, "plain-ex", "/plain", "starts_with", nil)
+	config.AddListener("external.address", "external", 2222, "localhost")
+	config.Listeners["external"].Routes = []string{"cars-ex", "plain-ex"}
+
+	routes := map[string]*route.Route{}
+	for _, r := range routeConfigs(t, config)[0].(*route.RouteConfiguration).VirtualHosts[0].Routes {
+		routes[r.Name] = r
+	}
+	assert.Nil(t, routes["cars-ex"].GetRoute().Cors, "cors should not use the deprecated route action field")
+	cors := &corsv3.CorsPolicy{}
+	err := routes["cars-ex"].TypedPerFilterConfig["envoy.filters.http.cors"].UnmarshalTo(cors)
+	assert.NoError(t, err, "cors policy should be a per filter config for the cors filter")
+
+	assert.Equal(t, "https://www.target.com", cors.AllowOriginStringMatch[0].GetExact(), "exact origin should match")
+	assert.Equal(t, `https://.*\.target\.com`, cors.AllowOriginStringMatch[1].GetSafeRegex().Regex, "regex origin should match")
+	assert.Equal(t, "GET,POST", cors.AllowMethods, "methods should be comma separated")
+	assert.Equal(t, "authorization,content-type", cors.AllowHeaders, "headers should be comma separated")
+	assert.Equal(t, "x-request-id", cors.ExposeHeaders, "exposed headers should match")
+	assert.Equal(t, "600", cors.MaxAge, "max age should be in seconds")
+	assert.True(t, cors.AllowCredentials.GetValue(), "credentials should be allowed")
+	assert.NotContains(t, routes["plain-ex"].TypedPerFilterConfig, "envoy.filters.http.cors", "route without cors shouldn't have a cors policy")
+}
+
+func TestMakeRoutesDirectResponses(t *testing.T) {
+	config := univcfg.NewConfig()
+	addRoute(t, config, "down-ex", "/down", "starts_with", nil).Direct = &univcfg.DirectResponse{Status: 503, Body: "down for maintenance"}
+	addRoute(t, config, "moved-ex", "/moved", "starts_with", nil).Redirect = &univcfg.Redirect{
+		Scheme: "https",
+		Host:   "cars.target.com",
+		Port:   8443,
+		Prefix: "/cars/v4",
+		Status: 308,
+	}
+	config.AddListener("external.address", "external", 2222, "localhost")
+	config.Listeners["external"].Routes = []string{"down-ex", "moved-ex"}
+
+	routes := map[string]*route.Route{}
+	for _, r := range routeConfigs(t, config)[0].(*route.RouteConfiguration).VirtualHosts[0].Routes {
+		routes[r.Name] = r
+	}
+	direct := routes["down-ex"].GetDirectResponse()
+	redirect := routes["moved-ex"].GetRedirect()
+
+	assert.Nil(t, routes["down-ex"].GetRoute(), "direct response shouldn't go to a cluster")
+	assert.Equal(t, uint32(503), direct.Status, "direct response status should match")
+	assert.Equal(t, "down for maintenance", direct.Body.GetInlineString(), "direct response body should match")
+	assert.Equal(t, "https", redirect.GetSchemeRedirect(), "redirect scheme should match")
+	assert.Equal(t, "cars.target.com", redirect.HostRedirect, "redirect host should match")
+	assert.Equal(t, uint32(8443), redirect.PortRedirect, "redirect port should match")
+	assert.Equal(t, "/cars/v4", redirect.GetPrefixRewrite(), "redirect prefix should match")
+	assert.Equal(t, route.RedirectAction_PERMANENT_REDIRECT, redirect.ResponseCode, "redirect status should match")
+}
+
+func TestProcessBagWithoutServers(t *testing.T) {
+	e := NewProcessor("node", false, listenerInfo)
+	err := e.Process(watcher.Message{
+		Operation: watcher.Create,
+		Path:      "../../databags/dev/registry_items_availabilities-v1.json",
+	})
+	assert.NoError(t, err, "bag without servers should process")
+
+	config := univcfg.MergeConfigs(e.Configs)
+	assert.Empty(t, config.Clusters, "bag without servers shouldn't have clusters")
+	for _, resource := range routeConfigs(t, config) {
+		for _, r := range resource.(*route.RouteConfiguration).VirtualHosts[0].Routes {
+			assert.Nil(t, r.GetRoute(), "route shouldn't point at a missing cluster")
+			assert.Equal(t, uint32(503), r.GetDirectResponse().Status, "route should answer with a 503")
+		}
+	}
+}
+
+func TestMakeClustersResilience(t *testing.T) {
+	config := univcfg.NewConfig()
+	c := addCluster(t, config, "legacy-in", "round_robin", nil)
+	c.CircuitBreaker = &univcfg.CircuitBreaker{MaxConnections: 100, MaxPendingRequests: 10, MaxRetries: 3}
+	c.OutlierDetection = &univcfg.OutlierDetection{Consecutive5xx: 3, EjectionTime: time.Minute, MaxEjectionPercent: 50}
+	addCluster(t, config, "plain-in", "round_robin", nil)
+	config.AddEndpoint("address1", "legacy-in", 1111, "", 0)
+	config.AddEndpoint("address2", "plain-in", 2222, "", 0)
+
+	clusters := map[string]*clusterv3.Cluster{}
+	for _, c := range makeClusters(config, nil) {
+		clusters[c.(*clusterv3.Cluster).Name] = c.(*clusterv3.Cluster)
+	}
+	threshold := clusters["legacy-in"].CircuitBreakers.Thresholds[0]
+	outlier := clusters["legacy-in"].OutlierDetection
+
+	assert.Equal(t, uint32(100), threshold.MaxConnections.GetValue(), "max connections should match")
+	assert.Equal(t, uint32(10), threshold.MaxPendingRequests.GetValue(), "max pending requests should match")
+	assert.Nil(t, threshold.MaxRequests, "unset limit should use envoy's default")
+	assert.Equal(t, uint32(3), threshold.MaxRetries.GetValue(), "max retries should match")
+	assert.Equal(t, uint32(3), outlier.Consecutive_5Xx.GetValue(), "consecutive 5xx should match")
+	assert.Equal(t, time.Minute, outlier.BaseEjectionTime.AsDuration(), "ejection time should match")
+	assert.Equal(t, uint32(50), outlier.MaxEjectionPercent.GetValue(), "max ejection percent should match")
+	assert.Nil(t, clusters["plain-in"].CircuitBreakers, "cluster without limits shouldn't have circuit breakers")
+	assert.Nil(t, clusters["plain-in"].OutlierDetection, "cluster without outlier settings shouldn't have outlier detection")
+}
+
+func TestMakeBalancePolicies(t *testing.T) {
+	config := univcfg.NewConfig()
+	addCluster(t, config, "sticky-in", "ring_hash", nil)
+	addCluster(t, config, "first-in", "first", nil)
+	config.AddEndpoint("address1", "sticky-in", 1111, "", 0)
+	config.AddEndpoint("address2", "first-in", 2222, "ttce", 0)
+	config.AddEndpoint("address3", "first-in", 3333, "ttc", 0)
+	config.AddEndpoint("address4", "first-in", 4444, "ttc", 0)
+	addRoute(t, config, "sticky-in", "/sticky", "starts_with", nil).HashPolicy = &univcfg.HashPolicy{Type: "header", Name: "x-user-id"}
+	config.AddListener("internal.address", "internal", 1111, "localhost")
+	config.Listeners["internal"].Routes = []string{"sticky-in"}
+
+	clusters := map[string]*clusterv3.Cluster{}
+	for _, c := range makeClusters(config, RegionPriorities([]string{"ttc", "ttce"})) {
+		clusters[c.(*clusterv3.Cluster).Name] = c.(*clusterv3.Cluster)
+	}
+	assert.Equal(t, clusterv3.Cluster_RING_HASH, clusters["sticky-in"].LbPolicy, "hash based cluster should use ring hash")
+
+	first := clusters["first-in"].LoadAssignment.Endpoints
+	assert.Equal(t, 3, len(first), "every endpoint should get its own priority")
+	for i, address := range []string{"address3", "address4", "address2"} {
+		assert.Equal(t, uint32(i), first[i].Priority, "priorities should count up")
+		assert.Equal(t, address, first[i].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress().Address,
+			"endpoints should be ordered by region preference, then databag order")
+	}
+
+	action := routeConfigs(t, config)[0].(*route.RouteConfiguration).VirtualHosts[0].Routes[0].GetRoute()
+	assert.Equal(t, "x-user-id", action.HashPolicy[0].GetHeader().HeaderName, "route should hash on the header")
+}
+
+func TestMakeClustersDiscoveryTypes(t *testing.T) {
+	config := univcfg.NewConfig()
+	addCluster(t, config, "ips-in", "round_robin", nil).DnsType = "strict"
+	addCluster(t, config, "strict-in", "round_robin", nil).DnsType = "strict"
+	addCluster(t, config, "logical-in", "round_robin", nil).DnsType = "logical"
+	config.AddEndpoint("10.0.0.1", "ips-in", 1111, "", 0)
+	config.AddEndpoint("2001:db8::1", "ips-in", 1111, "", 0)
+	config.AddEndpoint("10.0.0.2", "strict-in", 2222, "", 0)
+	config.AddEndpoint("address1", "strict-in", 2222, "", 0)
+	config.AddEndpoint("address2", "logical-in", 3333, "", 0)
+
+	clusters := map[string]*clusterv3.Cluster{}
+	for _, c := range makeClusters(config, nil) {
+		clusters[c.(*clusterv3.Cluster).Name] = c.(*clusterv3.Cluster)
+	}
+	assert.Equal(t, clusterv3.Cluster_EDS, clusters["ips-in"].GetType(), "ip only cluster should use eds")
+	assert.NotNil(t, clusters["ips-in"].EdsClusterConfig.EdsConfig, "eds cluster should point at the xds server")
+	assert.Nil(t, clusters["ips-in"].LoadAssignment, "eds cluster shouldn't have its endpoints inlined")
+	assert.Equal(t, clusterv3.Cluster_STRICT_DNS, clusters["strict-in"].GetType(), "cluster with a hostname should use strict dns")
+	assert.Equal(t, 2, len(clusters["strict-in"].LoadAssignment.Endpoints[0].LbEndpoints), "dns cluster should have its endpoints inlined")
+	assert.Equal(t, clusterv3.Cluster_LOGICAL_DNS, clusters["logical-in"].GetType(), "logical dns should be kept")
+
+	endpoints := makeEdsEndpoints(config, nil)
+	assert.Equal(t, 1, len(endpoints), "only the ip only cluster should have eds endpoints")
+	assert.Equal(t, "ips-in", endpoints[0].(*endpointv3.ClusterLoadAssignment).ClusterName, "eds endpoints should be named after the cluster")
+	assert.Equal(t, 2, len(endpoints[0].(*endpointv3.ClusterLoadAssignment).Endpoints[0].LbEndpoints), "eds endpoints should all be there")
+}
+
+func TestProcessEdsSnapshot(t *testing.T) {
+	e := NewProcessor("node", false, listenerInfo)
+	err := e.Process(watcher.Message{
+		Operation: watcher.Create,
+		Path:      "../../databags/dev/gateway_canary-v1.json",
+	})
+	assert.NoError(t, err, "bag with ip endpoints should make a consistent snapshot")
+
+	snapshot, _ := e.Cache.GetSnapshot("envoy-instance")
+	endpoints := snapshot.GetResources(resource.EndpointType)
+	assert.Equal(t, 1, len(endpoints), "only the ip endpoint should go over eds")
+	assert.Contains(t, endpoints, "gateway_canary-v1-vmaas-in", "eds endpoints should be named after the cluster")
+}
+
+func TestMakeClustersTls(t *testing.T) {
+	config := univcfg.NewConfig()
+	addCluster(t, config, "plain-in", "round_robin", nil)
+	addCluster(t, config, "tls-in", "round_robin", nil).Tls = &univcfg.UpstreamTls{
+		Sni:             "api.target.com",
+		CaFile:          "ca.crt",
+		SubjectAltNames: []string{"api.target.com"},
+		CertFile:        "client.crt",
+		KeyFile:         "client.key",
+	}
+	addCluster(t, config, "auto-in", "round_robin", nil).Tls = &univcfg.UpstreamTls{AutoSni: true, CaFile: "ca.crt"}
+	config.AddEndpoint("address1", "plain-in", 443, "", 0)
+	config.AddEndpoint("address2", "tls-in", 8443, "", 0).Tls = true
+	config.AddEndpoint("address3", "tls-in", 80, "", 0)
+	config.AddEndpoint("address4", "auto-in", 443, "", 0).Tls = true
+	config.AddEndpoint("address5", "auto-in", 443, "", 0).Tls = true
+
+	clusters := map[string]*clusterv3.Cluster{}
+	for _, c := range makeClusters(config, nil) {
+		clusters[c.(*clusterv3.Cluster).Name] = c.(*clusterv3.Cluster)
+	}
+	assert.Nil(t, clusters["plain-in"].TransportSocketMatches, "port 443 alone shouldn't turn on tls")
+	assert.Equal(t, 1, len(clusters["tls-in"].TransportSocketMatches), "tls cluster should have a tls transport socket")
+
+	ctx := &tlsv3.UpstreamTlsContext{}
+	err := clusters["tls-in"].TransportSocketMatches[0].TransportSocket.GetTypedConfig().UnmarshalTo(ctx)
+	assert.NoError(t, err, "transport socket should hold an upstream tls context")
+	assert.Equal(t, "api.target.com", ctx.Sni, "sni should be sent")
+	assert.Equal(t, "ca.crt", ctx.CommonTlsContext.GetValidationContext().TrustedCa.GetFilename(), "endpoints should be verified against the ca")
+	assert.Equal(t, "api.target.com", ctx.CommonTlsContext.GetValidationContext().MatchTypedSubjectAltNames[0].Matcher.GetExact(), "subject alt name should be checked")
+	assert.Equal(t, "client.crt", ctx.CommonTlsContext.TlsCertificates[0].CertificateChain.GetFilename(), "client cert should be presented")
+	assert.Equal(t, "client.key", ctx.CommonTlsContext.TlsCertificates[0].PrivateKey.GetFilename(), "client key should be presented")
+
+	lbEndpoints := clusters["tls-in"].LoadAssignment.Endpoints[0].LbEndpoints
+	assert.Equal(t, true, lbEndpoints[0].Metadata.FilterMetadata["envoy.transport_socket_match"].Fields["tls"].GetBoolValue(), "https endpoint should match the tls transport socket")
+	assert.Nil(t, lbEndpoints[1].Metadata, "http endpoint should stay plaintext")
+
+	// endpoints with different hostnames are each sent, and verified against, their own name
+	assert.Nil(t, clusters["tls-in"].TypedExtensionProtocolOptions, "cluster with one sni shouldn't pick it per request")
+	options := &upstreamhttpv3.HttpProtocolOptions{}
+	err = clusters["auto-in"].TypedExtensionProtocolOptions["envoy.extensions.upstreams.http.v3.HttpProtocolOptions"].UnmarshalTo(options)
+	assert.NoError(t, err, "cluster should hold http protocol options")
+	assert.True(t, options.UpstreamHttpProtocolOptions.AutoSni, "sni should come from each request's host")
+	assert.True(t, options.UpstreamHttpProtocolOptions.AutoSanValidation, "certificate should be checked against each request's host")
+}
+
+func TestProcessOverlays(t *testing.T) {
+	prod := NewProcessor("node", false, listenerInfo)
+	prod.Env = "prod"
+	err := prod.Process(watcher.Message{
+		Operation: watcher.Create,
+		Path:      "test_folder/env",
+	})
+	assert.NoError(t, err, "bags with overlays should be processed")
+	assert.Equal(t, 1, len(prod.Configs), "overlays shouldn't be treated as bags")
+
+	config := prod.Configs["test_folder/env/cars.json"]
+	assert.NotNil(t, config.Clusters["cars-v1-ie"], "overlay should change the bag's availability")
+	assert.Equal(t, "cars1.prod.address", config.Endpoints["cars-v1-ie"][0].Address, "overlay should replace the endpoints")
+	assert.Equal(t, uint(3), config.Endpoints["cars-v1-ie"][0].Weight, "overlay should replace the weights")
+	assert.Equal(t, "cars2.prod.address", config.Endpoints["cars-v1-ie"][1].Address, "overlay should replace the endpoints")
+	assert.Equal(t, "search.prod.address", config.Endpoints["cars-v1-search-ie"][0].Address, "each backend should get its own patch")
+	assert.Equal(t, "/cars/v1/search", config.Routes["cars-v1-search-ie"].Path, "fields the overlay leaves out should be kept")
+
+	stage := NewProcessor("node", false, listenerInfo)
+	stage.Env = "stage"
+	stage.Process(watcher.Message{Operation: watcher.Create, Path: "test_folder/env"})
+	config = stage.Configs["test_folder/env/cars.json"]
+	assert.Equal(t, "cars.stage.address", config.Endpoints["cars-v1-in"][0].Address, "overlay should match the environment")
+	assert.Equal(t, "search.dev.address", config.Endpoints["cars-v1-search-in"][0].Address, "backends without a patch should be kept")
+
+	dev := NewProcessor("node", false, listenerInfo)
+	dev.Process(watcher.Message{Operation: watcher.Create, Path: "test_folder/env"})
+	config = dev.Configs["test_folder/env/cars.json"]
+	assert.Equal(t, "cars.dev.address", config.Endpoints["cars-v1-in"][0].Address, "overlays should be ignored without an environment")
+
+	// removing the overlay puts the base bag back
+	err = prod.Process(watcher.Message{
+		Operation: watcher.Delete,
+		Path:      "test_folder/env/overlays/prod",
+	})
+	assert.NoError(t, err, "deleting an overlay should not produce an error")
+	config = prod.Configs["test_folder/env/cars.json"]
+	assert.Equal(t, "cars.dev.address", config.Endpoints["cars-v1-in"][0].Address, "bag should lose its overlay")
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "overlays", "prod"), 0755)
+	os.WriteFile(filepath.Join(dir, "cars.json"), []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "cars.address"}]}}]}`), 0644)
+	os.WriteFile(filepath.Join(dir, "overlays", "prod", "a.json"), []byte(`{"id": "cars-v1", "backends": [{"balance": "fastest"}]}`), 0644)
+	broken := NewProcessor("node", false, listenerInfo)
+	broken.Env = "prod"
+	err = broken.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.ErrorContains(t, err, "(cars-v1 overlay): backends[0].balance:", "patched bag should be validated")
+
+	os.WriteFile(filepath.Join(dir, "overlays", "prod", "a.json"), []byte(`{"backends": []}`), 0644)
+	err = broken.Process(watcher.Message{Operation: watcher.Modify, Path: filepath.Join(dir, "overlays", "prod", "a.json")})
+	assert.ErrorContains(t, err, "overlay 0 has no bag id", "overlay without an id should fail")
+
+	os.WriteFile(filepath.Join(dir, "overlays", "prod", "a.json"), []byte(`{"id": "cars-v1"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "overlays", "prod", "b.json"), []byte(`{"id": "cars-v1"}`), 0644)
+	broken = NewProcessor("node", false, listenerInfo)
+	broken.Env = "prod"
+	err = broken.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.ErrorContains(t, err, "bag cars-v1 has overlays in both", "bag should only have one overlay")
+
+	// an overlay for a bag that doesn't exist is reported once every file has been read
+	os.Remove(filepath.Join(dir, "overlays", "prod", "b.json"))
+	os.WriteFile(filepath.Join(dir, "overlays", "prod", "a.json"), []byte(`[{"id": "cars-v1"}, {"id": "cars-v9"}]`), 0644)
+	broken = NewProcessor("node", false, listenerInfo)
+	broken.Env = "prod"
+	err = broken.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.EqualError(t, err, filepath.Join(dir, "overlays", "prod", "a.json")+": overlay for bag cars-v9 patches nothing, there's no bag with that id",
+		"unused overlay should be reported")
+	assert.NotNil(t, broken.Configs[filepath.Join(dir, "cars.json")], "bags should still be processed")
+
+	// backends are patched by their path pattern, not their position
+	os.WriteFile(filepath.Join(dir, "cars.json"), []byte(`{"id": "cars-v1", "backends": [
+		{"match": {"path": {"pattern": "/cars/v1/search"}}, "servers": {"endpoints": [{"address": "search.address"}]}},
+		{"servers": {"endpoints": [{"address": "cars.address"}]}}
+	]}`), 0644)
+	os.WriteFile(filepath.Join(dir, "overlays", "prod", "a.json"), []byte(`{"id": "cars-v1", "backends": [
+		{"servers": {"endpoints": [{"address": "cars.prod.address"}]}}
+	]}`), 0644)
+	broken = NewProcessor("node", false, listenerInfo)
+	broken.Env = "prod"
+	err = broken.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.NoError(t, err, "backend patch should find its backend")
+	config = broken.Configs[filepath.Join(dir, "cars.json")]
+	assert.Equal(t, "cars.prod.address", config.Endpoints["cars-v1-ie"][0].Address, "default backend should be patched")
+	assert.Equal(t, "search.address", config.Endpoints["cars-v1-search-ie"][0].Address, "backend listed first shouldn't be patched")
+
+	os.WriteFile(filepath.Join(dir, "overlays", "prod", "a.json"), []byte(`{"id": "cars-v1", "backends": [
+		{"match": {"path": {"pattern": "/cars/v1/serch"}}, "servers": {"endpoints": [{"address": "search.prod.address"}]}}
+	]}`), 0644)
+	err = broken.Process(watcher.Message{Operation: watcher.Modify, Path: filepath.Join(dir, "overlays", "prod", "a.json")})
+	assert.ErrorContains(t, err, `no backend with the match {"path":{"pattern":"/cars/v1/serch"}} to patch`, "backend patch without a backend should fail")
+
+	// backends sharing a path are told apart by the rest of their match conditions
+	os.WriteFile(filepath.Join(dir, "cars.json"), []byte(`{"id": "cars-v1", "backends": [
+		{"match": {"path": {"pattern": "/cars/v1"}, "methods": ["GET"]}, "servers": {"endpoints": [{"address": "reads.address"}]}},
+		{"match": {"path": {"pattern": "/cars/v1"}, "methods": ["POST", "PUT"]}, "servers": {"endpoints": [{"address": "writes.address"}]}}
+	]}`), 0644)
+	os.WriteFile(filepath.Join(dir, "overlays", "prod", "a.json"), []byte(`{"id": "cars-v1", "backends": [
+		{"match": {"path": {"pattern": "/cars/v1"}, "methods": ["PUT", "POST"]}, "servers": {"endpoints": [{"address": "writes.prod.address"}]}}
+	]}`), 0644)
+	broken = NewProcessor("node", false, listenerInfo)
+	broken.Env = "prod"
+	err = broken.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.NoError(t, err, "backend patch should find its backend by its match conditions")
+	addresses := map[string]string{}
+	for name, r := range broken.Configs[filepath.Join(dir, "cars.json")].Routes {
+		addresses[strings.Join(r.Methods, ",")] = broken.Configs[filepath.Join(dir, "cars.json")].Endpoints[name][0].Address
+	}
+	assert.Equal(t, "reads.address", addresses["GET"], "backend with other match conditions shouldn't be patched")
+	assert.Equal(t, "writes.prod.address", addresses["POST,PUT"], "backend with the patch's match conditions should be patched")
+
+	os.WriteFile(filepath.Join(dir, "overlays", "prod", "a.json"), []byte(`{"id": "cars-v1", "backends": [
+		{"match": {"path": {"pattern": "/cars/v1"}}, "servers": {"endpoints": [{"address": "cars.prod.address"}]}}
+	]}`), 0644)
+	err = broken.Process(watcher.Message{Operation: watcher.Modify, Path: filepath.Join(dir, "overlays", "prod", "a.json")})
+	assert.ErrorContains(t, err, `several backends with the match {"path":{"pattern":"/cars/v1"}}`, "backend patch picking several backends should fail")
+}
+
+func TestProcessConflicts(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "cars.json")
+	copied := filepath.Join(dir, "cars-copy.json")
+	other := filepath.Join(dir, "trucks.json")
+	os.WriteFile(original, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "cars.address"}]}}]}`), 0644)
+	os.WriteFile(other, []byte(`{"id": "trucks-v1", "backends": [{"servers": {"endpoints": [{"address": "trucks.address"}]}}]}`), 0644)
+	hourAgo := time.Now().Add(-time.Hour)
+	os.Chtimes(original, hourAgo, hourAgo)
+
+	e := NewProcessor("node", false, listenerInfo)
+	err := e.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.NoError(t, err, "bags without conflicts should process")
+	assert.Empty(t, e.Conflicts, "bags without conflicts shouldn't report any")
+
+	// a copy added later (even if it sorts first) shouldn't take over the original's api
+	os.WriteFile(copied, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "hijack.address"}]}}]}`), 0644)
+	err = e.Process(watcher.Message{Operation: watcher.Create, Path: copied})
+	assert.NoError(t, err, "conflicts should be reported, not fail the snapshot")
+	assert.Equal(t, 1, len(e.Conflicts), "cluster and its route should only be reported once")
+	assert.Equal(t, univcfg.Conflict{Kind: "cluster", Name: "cars-v1-ie", Older: original, Newer: copied}, e.Conflicts[0], "conflict should name both files")
+	assert.Equal(t, "cluster cars-v1-ie is claimed by both "+original+" and "+copied, e.Conflicts[0].String(), "conflict should read well")
+	assert.Equal(t, []Quarantined{{Path: copied, Reason: e.Conflicts[0].String()}}, e.QuarantinedFiles(), "newer bag should be listed as quarantined")
+
+	snapshot, _ := e.Cache.GetSnapshot("envoy-instance")
+	clusters := snapshot.GetResources(resource.ClusterType)
+	assert.Contains(t, clusters, "cars-v1-ie", "older bag should be kept")
+	assert.Contains(t, clusters, "trucks-v1-ie", "bags outside the conflict should be kept")
+	endpoints := clusters["cars-v1-ie"].(*clusterv3.Cluster).LoadAssignment.Endpoints[0].LbEndpoints
+	assert.Equal(t, 1, len(endpoints), "endpoints of the newer bag shouldn't be appended")
+	assert.Equal(t, "cars.address", endpoints[0].GetEndpoint().Address.GetSocketAddress().Address, "older bag's endpoints should be used")
+
+	// changing the original doesn't make it the newer one
+	err = e.Process(watcher.Message{Operation: watcher.Modify, Path: original})
+	assert.NoError(t, err, "modifying the original should not produce an error")
+	assert.Equal(t, copied, e.Conflicts[0].Newer, "original should stay the older bag")
+
+	// after a restart the copy is read first, but its file is still the newer one
+	restarted := NewProcessor("node", false, listenerInfo)
+	err = restarted.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.NoError(t, err, "conflicts should be reported, not fail the snapshot")
+	assert.Equal(t, e.Conflicts, restarted.Conflicts, "restarting shouldn't change which bag wins")
+
+	e.ConflictPolicy = "both"
+	err = e.Process(watcher.Message{Operation: watcher.Modify, Path: copied})
+	assert.NoError(t, err, "conflicts should be reported, not fail the snapshot")
+	snapshot, _ = e.Cache.GetSnapshot("envoy-instance")
+	clusters = snapshot.GetResources(resource.ClusterType)
+	assert.NotContains(t, clusters, "cars-v1-ie", "both bags should be left out")
+	assert.Equal(t, []string{copied, original}, []string{e.QuarantinedFiles()[0].Path, e.QuarantinedFiles()[1].Path},
+		"both bags should be listed as quarantined")
+	assert.Contains(t, clusters, "trucks-v1-ie", "bags outside the conflict should be kept")
+
+	err = e.Process(watcher.Message{Operation: watcher.Delete, Path: copied})
+	assert.NoError(t, err, "deleting the copy should not produce an error")
+	assert.Empty(t, e.Conflicts, "deleting the copy should end the conflict")
+
+	snapshot, _ = e.Cache.GetSnapshot("envoy-instance")
+	assert.Contains(t, snapshot.GetResources(resource.ClusterType), "cars-v1-ie", "original should be back")
+
+	// a copy on more listeners gets differently named routes, but still matches the same requests on the shared listener
+	os.WriteFile(original, []byte(`{"id": "cars-v3", "availability": ["internal"], "backends": [{"servers": {"endpoints": [{"address": "cars.address"}]}}]}`), 0644)
+	os.Chtimes(original, hourAgo, hourAgo)
+	e = NewProcessor("node", false, listenerInfo)
+	err = e.Process(watcher.Message{Operation: watcher.Create, Path: original})
+	assert.NoError(t, err, "original should process")
+	os.WriteFile(copied, []byte(`{"id": "cars-v3", "availability": ["internal", "external"], "backends": [{"servers": {"endpoints": [{"address": "hijack.address"}]}}]}`), 0644)
+	err = e.Process(watcher.Message{Operation: watcher.Create, Path: copied})
+	assert.NoError(t, err, "conflicts should be reported, not fail the snapshot")
+	assert.Equal(t, 1, len(e.Conflicts), "copy should conflict with the original")
+	assert.Equal(t, univcfg.Conflict{Kind: "path", Name: "/cars/v3 (starts_with, on internal)", Older: original, Newer: copied}, e.Conflicts[0],
+		"conflict should name the shared route match")
+	snapshot, _ = e.Cache.GetSnapshot("envoy-instance")
+	clusters = snapshot.GetResources(resource.ClusterType)
+	assert.Contains(t, clusters, "cars-v3-in", "original should be kept")
+	assert.NotContains(t, clusters, "cars-v3-ie", "copy shouldn't take over the original's path")
+}
+
+func TestMakeRoutesOrder(t *testing.T) {
+	config := univcfg.NewConfig()
+	addRoute(t, config, "cars-in", "/cars", "starts_with", nil)
+	addRoute(t, config, "cars-v3-in", "/cars/v3", "starts_with", nil)
+	addRoute(t, config, "cars-v3-beta-in", "/cars/v3", "starts_with", nil).Methods = []string{"POST"}
+	addRoute(t, config, "cars-v3-ratelimit-in", "/cars/v3/ratelimit", "exact", nil)
+	addRoute(t, config, "cars-v3-search-in", "^/cars/v3/search/[0-9]+$", "regex", nil)
+	addRoute(t, config, "trucks-in", "/trucks", "starts_with", nil)
+	addRoute(t, config, "bikes-in", "/bikes", "starts_with", nil)
+	addCluster(t, config, "cars-in", "round_robin", nil)
+	addCluster(t, config, "bikes-in", "round_robin", nil)
+	addCluster(t, config, "trucks-in", "round_robin", nil)
+	config.AddEndpoint("cars.address", "cars-in", 443, "", 0)
+	config.AddEndpoint("bikes.address", "bikes-in", 443, "", 0)
+	config.AddEndpoint("trucks.address", "trucks-in", 443, "", 0)
+	config.AddListener("internal.address", "internal", 1111, "localhost")
+	for name := range config.Routes {
+		config.Listeners["internal"].Routes = append(config.Listeners["internal"].Routes, name)
+	}
+
+	expected := []string{
+		"cars-v3-ratelimit-in",
+		"cars-v3-search-in",
+		"cars-v3-beta-in",
+		"cars-v3-in",
+		"trucks-in",
+		"bikes-in",
+		"cars-in",
+	}
+	for i := 0; i < 10; i++ {
+		var names []string
+		for _, r := range routeConfigs(t, config)[0].(*route.RouteConfiguration).VirtualHosts[0].Routes {
+			names = append(names, r.Name)
+		}
+		assert.Equal(t, expected, names, "routes should go from most to least specific, whatever order they were added in")
+
+		var clusters []string
+		for _, c := range makeClusters(config, nil) {
+			clusters = append(clusters, c.(*clusterv3.Cluster).Name)
+		}
+		assert.Equal(t, []string{"bikes-in", "cars-in", "trucks-in"}, clusters, "clusters should be sorted by name")
+
+		// listener routes are filled from a map, so shuffle them the way the next merge might
+		routes := config.Listeners["internal"].Routes
+		routes[0], routes[len(routes)-1-i%len(routes)] = routes[len(routes)-1-i%len(routes)], routes[0]
+	}
+}
+
+func TestSnapshotVersions(t *testing.T) {
+	dir := t.TempDir()
+	cars := filepath.Join(dir, "cars.json")
+	trucks := filepath.Join(dir, "trucks.json")
+	os.WriteFile(cars, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "cars.address"}]}}]}`), 0644)
+	os.WriteFile(trucks, []byte(`{"id": "trucks-v1", "backends": [{"servers": {"endpoints": [{"address": "10.0.0.1", "port": 8080}]}}]}`), 0644)
+
+	e := NewProcessor("node", false, listenerInfo)
+	err := e.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.NoError(t, err, "function call should not produce error")
+	first, _ := e.Cache.GetSnapshot("envoy-instance")
+	version := e.Version
+	assert.Len(t, version, 16, "version should be a cut down hash")
+
+	// a restarted control plane reading the same files should land on the same versions
+	restarted := NewProcessor("node", false, listenerInfo)
+	restarted.Process(watcher.Message{Operation: watcher.Create, Path: trucks})
+	restarted.Process(watcher.Message{Operation: watcher.Create, Path: cars})
+	assert.Equal(t, version, restarted.Version, "same config should get the same version")
+	second, _ := restarted.Cache.GetSnapshot("envoy-instance")
+	for _, typ := range []string{resource.ListenerType, resource.ClusterType, resource.RouteType, resource.EndpointType} {
+		assert.Equal(t, first.GetVersion(typ), second.GetVersion(typ), "same resources should get the same version")
+	}
+	assert.NotEmpty(t, first.GetVersionMap(resource.ClusterType)["cars-v1-ie"], "resources should get their own versions")
+
+	// saving a file without changing it shouldn't push anything
+	err = e.Process(watcher.Message{Operation: watcher.Modify, Path: cars})
+	assert.NoError(t, err, "function call should not produce error")
+	unchanged, _ := e.Cache.GetSnapshot("envoy-instance")
+	assert.Same(t, first, unchanged, "unchanged config shouldn't replace the snapshot")
+
+	// only the types that changed get a new version
+	os.WriteFile(trucks, []byte(`{"id": "trucks-v1", "backends": [{"servers": {"endpoints": [{"address": "10.0.0.2", "port": 8080}]}}]}`), 0644)
+	err = e.Process(watcher.Message{Operation: watcher.Modify, Path: trucks})
+	assert.NoError(t, err, "function call should not produce error")
+	changed, _ := e.Cache.GetSnapshot("envoy-instance")
+	assert.NotEqual(t, version, e.Version, "changed config should get a new version")
+	assert.NotEqual(t, first.GetVersion(resource.EndpointType), changed.GetVersion(resource.EndpointType), "eds endpoints changed")
+	assert.Equal(t, first.GetVersion(resource.ClusterType), changed.GetVersion(resource.ClusterType), "clusters didn't change")
+	assert.Equal(t, first.GetVersion(resource.ListenerType), changed.GetVersion(resource.ListenerType), "listeners didn't change")
+}
+
+func TestProcessQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	cars := filepath.Join(dir, "cars.json")
+	trucks := filepath.Join(dir, "trucks.json")
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(cars, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "cars.address"}]}}]}`), 0644)
+	os.WriteFile(trucks, []byte(`{"id": "trucks-v1", "backends": [{"servers": {"endpoints": [{"address": "trucks.address"}]}}]}`), 0644)
+	os.WriteFile(bad, []byte(`{"id": "bad-v1", "backends": 5}`), 0644)
+
+	e := NewProcessor("node", false, listenerInfo)
+	err := e.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.ErrorContains(t, err, bad, "rejected file should be reported")
+	quarantined := e.QuarantinedFiles()
+	assert.Equal(t, []string{bad}, quarantinedPaths(e), "only the bad file should be quarantined")
+	assert.Contains(t, quarantined[0].Reason, "backends", "quarantine should say why")
+	snapshot, _ := e.Cache.GetSnapshot("envoy-instance")
+	clusters := snapshot.GetResources(resource.ClusterType)
+	assert.Contains(t, clusters, "cars-v1-ie", "good files should still be served")
+	assert.Contains(t, clusters, "trucks-v1-ie", "good files should still be served")
+
+	// breaking a file keeps its last good config around
+	os.WriteFile(cars, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": "nope"}}]}`), 0644)
+	err = e.Process(watcher.Message{Operation: watcher.Modify, Path: cars})
+	assert.ErrorContains(t, err, cars, "rejected change should be reported")
+	assert.Contains(t, quarantinedPaths(e), cars, "broken file should be quarantined")
+	assert.Equal(t, "cars.address", e.Configs[cars].Endpoints["cars-v1-ie"][0].Address, "last good config should be kept")
+	snapshot, _ = e.Cache.GetSnapshot("envoy-instance")
+	assert.Contains(t, snapshot.GetResources(resource.ClusterType), "cars-v1-ie", "last good config should still be served")
+
+	// fixing it takes it out of quarantine
+	os.WriteFile(cars, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "fixed.address"}]}}]}`), 0644)
+	err = e.Process(watcher.Message{Operation: watcher.Modify, Path: cars})
+	assert.NoError(t, err, "fixed file should process")
+	assert.NotContains(t, quarantinedPaths(e), cars, "fixed file should leave quarantine")
+	assert.Equal(t, "fixed.address", e.Configs[cars].Endpoints["cars-v1-ie"][0].Address, "fixed config should be used")
+
+	err = e.Process(watcher.Message{Operation: watcher.Delete, Path: bad})
+	assert.NoError(t, err, "deleting the bad file should not produce an error")
+	assert.Empty(t, e.QuarantinedFiles(), "deleted file should leave quarantine")
+
+	// bad input that gets past the schema is an error, not a panic
+	config := univcfg.NewConfig()
+	_, err = config.AddCluster("cars-v1", "round_robin", nil)
+	assert.ErrorContains(t, err, "invalid availability", "cluster name without availability should be rejected")
+	_, err = config.AddRoute("cars-v1", "/cars", "starts_with", nil)
+	assert.ErrorContains(t, err, "invalid availability", "route name without availability should be rejected")
+	addRoute(t, config, "cars-v1-in", "/cars", "prefix", nil)
+	config.AddListener("internal.address", "internal", 1111, "localhost")
+	config.Listeners["internal"].Routes = []string{"cars-v1-in"}
+	_, err = makeRoutes(config)
+	assert.ErrorContains(t, err, "invalid path type", "unknown path type should be rejected")
+}
+
+// helper: paths of the quarantined files, in order
+func quarantinedPaths(e *EnvoyProcessor) []string {
+	var paths []string
+	for _, file := range e.QuarantinedFiles() {
+		paths = append(paths, file.Path)
+	}
+	return paths
+}
+
+func TestProcessBatch(t *testing.T) {
+	dir := t.TempDir()
+	cars := filepath.Join(dir, "cars.json")
+	trucks := filepath.Join(dir, "trucks.json")
+	os.WriteFile(cars, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "cars.address"}]}}]}`), 0644)
+
+	e := NewProcessor("node", false, listenerInfo)
+	err := e.Process(watcher.Message{Operation: watcher.Create, Path: dir})
+	assert.NoError(t, err, "function call should not produce error")
+	version := e.Version
+
+	// a directory and the files in it are only read once, and envoy gets a single snapshot
+	os.WriteFile(cars, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "new.address"}]}}]}`), 0644)
+	os.WriteFile(trucks, []byte(`{"id": "trucks-v1", "backends": [{"servers": {"endpoints": [{"address": "trucks.address"}]}}]}`), 0644)
+	err = e.ProcessBatch([]watcher.Message{
+		{Operation: watcher.Modify, Path: cars},
+		{Operation: watcher.Create, Path: trucks},
+		{Operation: watcher.Create, Path: filepath.Join(dir, "gone.json")},
+	})
+	assert.NoError(t, err, "file that's gone before the batch is read should count as deleted")
+	assert.NotEqual(t, version, e.Version, "batch should make a new snapshot")
+	assert.Equal(t, "new.address", e.Configs[cars].Endpoints["cars-v1-ie"][0].Address, "changed file should be read")
+	snapshot, _ := e.Cache.GetSnapshot("envoy-instance")
+	clusters := snapshot.GetResources(resource.ClusterType)
+	assert.Contains(t, clusters, "cars-v1-ie", "every change in the batch should be in the snapshot")
+	assert.Contains(t, clusters, "trucks-v1-ie", "every change in the batch should be in the snapshot")
+
+	// files of a walked directory aren't processed again
+	e.Configs[cars].Endpoints["cars-v1-ie"][0].Address = "stale.address"
+	err = e.ProcessBatch([]watcher.Message{
+		{Operation: watcher.Modify, Path: dir},
+		{Operation: watcher.Modify, Path: cars},
+	})
+	assert.NoError(t, err, "function call should not produce error")
+	assert.Equal(t, "new.address", e.Configs[cars].Endpoints["cars-v1-ie"][0].Address, "walking the directory should read the file")
+
+	err = e.ProcessBatch([]watcher.Message{
+		{Operation: watcher.Delete, Path: cars},
+		{Operation: watcher.Delete, Path: trucks},
+	})
+	assert.NoError(t, err, "deletes should not produce an error")
+	assert.Empty(t, e.Configs, "every deleted file should be gone")
+
+	// a file listed before its directory is still only read once, by the walk
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`{"id": "bad-v1", "backends": 5}`), 0644)
+	err = e.ProcessBatch([]watcher.Message{
+		{Operation: watcher.Create, Path: bad},
+		{Operation: watcher.Create, Path: dir},
+	})
+	assert.Equal(t, 1, strings.Count(err.Error(), bad+":"), "file should only be read once")
+	os.Remove(bad)
+	e.Process(watcher.Message{Operation: watcher.Delete, Path: bad})
+
+	// bags are only patched again once, however many overlays the batch changes
+	os.MkdirAll(filepath.Join(dir, "overlays", "prod"), 0755)
+	first := filepath.Join(dir, "overlays", "prod", "a.json")
+	second := filepath.Join(dir, "overlays", "prod", "b.json")
+	os.WriteFile(first, []byte(`{"id": "cars-v1", "backends": [{"servers": {"endpoints": [{"address": "cars.prod.address"}]}}]}`), 0644)
+	os.WriteFile(second, []byte(`{"id": "trucks-v1", "backends": [{"balance": "fastest"}]}`), 0644)
+	e.Env = "prod"
+	err = e.ProcessBatch([]watcher.Message{
+		{Operation: watcher.Create, Path: first},
+		{Operation: watcher.Create, Path: second},
+	})
+	assert.Equal(t, 1, strings.Count(err.Error(), "(trucks-v1 overlay)"), "bags should be patched once for the whole batch")
+	assert.Equal(t, "cars.prod.address", e.Configs[cars].Endpoints["cars-v1-ie"][0].Address, "overlays should be applied")
+}
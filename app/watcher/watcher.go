@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -24,6 +25,9 @@ type Message struct {
 
 var watcher *fsnotify.Watcher
 
+// a batch is sent on after at most this many quiet periods, even if changes keep coming
+const maxQuietPeriods = 10
+
 // keeps track of changes in specified directory and any sub-directories
 func Watch(directory string, change chan<- Message) error {
 	// initialize watcher
@@ -104,3 +108,61 @@ func addWatchers(root string, info os.FileInfo, err error) error {
 	}
 	return nil
 }
+
+// collect messages until nothing has changed for the quiet period, then send them on as one batch
+// each path is only in a batch once, so it gets read after whatever was writing it is done
+// a quiet period of 0 sends every message on as its own batch
+func Debounce(in <-chan Message, out chan<- []Message, quiet time.Duration) {
+	var batch []Message
+	var timer, deadline <-chan time.Time
+	for {
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				if len(batch) != 0 {
+					out <- batch
+				}
+				close(out)
+				return
+			}
+			batch = coalesce(batch, msg)
+			if quiet <= 0 {
+				out <- batch
+				batch = nil
+				continue
+			}
+			if deadline == nil {
+				deadline = time.After(quiet * maxQuietPeriods)
+			}
+			timer = time.After(quiet)
+		case <-timer:
+			out <- batch
+			batch, timer, deadline = nil, nil, nil
+		case <-deadline:
+			out <- batch
+			batch, timer, deadline = nil, nil, nil
+		}
+	}
+}
+
+// helper: add a message to a batch, replacing the one already there for the same path
+// the path is read when the batch is processed, so it's what happened to it last that matters, except:
+// - a file that was created and then written to is still new
+// - a file that was deleted and then created again has changed, its old config has to go
+func coalesce(batch []Message, msg Message) []Message {
+	for i, queued := range batch {
+		if queued.Path != msg.Path {
+			continue
+		}
+		gone := queued.Operation == Delete || queued.Operation == Move
+		if queued.Operation == Create && msg.Operation == Modify {
+			return batch
+		} else if gone && msg.Operation == Create {
+			batch[i].Operation = Modify
+		} else {
+			batch[i].Operation = msg.Operation
+		}
+		return batch
+	}
+	return append(batch, msg)
+}
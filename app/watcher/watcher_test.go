@@ -55,3 +55,35 @@ func TestWatch(t *testing.T) {
 	assert.Equal(t, Delete, msg.Operation, "operation type should be Delete (3)")
 	assert.Equal(t, "directory", msg.Path, "path to file should be \"file.txt\"")
 }
+
+func TestDebounce(t *testing.T) {
+	in := make(chan Message)
+	out := make(chan []Message, 2)
+	go Debounce(in, out, 50*time.Millisecond)
+
+	in <- Message{Operation: Create, Path: "cars.json"}
+	in <- Message{Operation: Modify, Path: "cars.json"}
+	in <- Message{Operation: Delete, Path: "trucks.json"}
+	in <- Message{Operation: Create, Path: "trucks.json"}
+	in <- Message{Operation: Modify, Path: "bikes.json"}
+	in <- Message{Operation: Move, Path: "bikes.json"}
+	batch := <-out
+	assert.Equal(t, []Message{
+		{Operation: Create, Path: "cars.json"},
+		{Operation: Modify, Path: "trucks.json"},
+		{Operation: Move, Path: "bikes.json"},
+	}, batch, "burst should be collapsed into one message per path")
+
+	in <- Message{Operation: Modify, Path: "cars.json"}
+	close(in)
+	assert.Equal(t, []Message{{Operation: Modify, Path: "cars.json"}}, <-out, "changes after a quiet period should be a new batch")
+	_, ok := <-out
+	assert.False(t, ok, "batches should end when the messages do")
+
+	in = make(chan Message)
+	out = make(chan []Message, 2)
+	go Debounce(in, out, 0)
+	in <- Message{Operation: Modify, Path: "cars.json"}
+	assert.Equal(t, []Message{{Operation: Modify, Path: "cars.json"}}, <-out, "no quiet period should send every message on its own")
+	close(in)
+}
@@ -4,14 +4,20 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	server "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 	test "github.com/envoyproxy/go-control-plane/pkg/test/v3"
 
+	prxycfg "github.com/fmgornick/dynamic-proxy/app/config/proxy"
 	univcfg "github.com/fmgornick/dynamic-proxy/app/config/universal"
+	parser "github.com/fmgornick/dynamic-proxy/app/parser"
 	prnt "github.com/fmgornick/dynamic-proxy/app/print"
 	processor "github.com/fmgornick/dynamic-proxy/app/processor"
 	watcher "github.com/fmgornick/dynamic-proxy/app/watcher"
@@ -20,7 +26,10 @@ import (
 
 var (
 	addHttp   bool
+	conflicts string
+	debounce  time.Duration
 	directory string
+	env       string
 
 	iAddr  string
 	iPort  uint
@@ -29,16 +38,35 @@ var (
 	eAddr  string
 	ePort  uint
 	eCName string
+
+	gAddr  string
+	gPort  uint
+	gCName string
+
+	groupsHeader     string
+	groupsTrusted    string
+	headersFile      string
+	rateLimitCounts  string
+	rateLimitService string
+	regions          string
+
+	upstreamCa   string
+	upstreamCert string
+	upstreamKey  string
 )
 
 var change chan watcher.Message        // used to keep track of changes to specified directory
+var batches chan []watcher.Message     // changes collected until the directory goes quiet
 var gracefulTermination chan os.Signal // sends last update to envoy to clear everything
 var envoy *processor.EnvoyProcessor    // used to send new configuration to envoy
 
 func init() {
 	// initialize environment variables, these can be set by user when running program via setting the flags
 	flag.BoolVar(&addHttp, "add-http", false, "optional flag for setting up listeners with HTTP compatability")
+	flag.StringVar(&conflicts, "conflicts", "newer", "which databags are ignored when two claim the same route or cluster, \"newer\" or \"both\"")
+	flag.DurationVar(&debounce, "debounce", 200*time.Millisecond, "how long the databag folder has to go without changes before they're processed together, 0 processes every change on its own")
 	flag.StringVar(&directory, "dir", "databags/dev", "path to folder containing databag files")
+	flag.StringVar(&env, "env", "", "environment whose overlays (under overlays/<env> in the databag folder) get merged into the databags")
 
 	flag.StringVar(&iAddr, "ia", "0.0.0.0", "address the proxy's internal listener listens on")
 	flag.UintVar(&iPort, "ip", 7777, "port number our internal listener listens on")
@@ -48,8 +76,24 @@ func init() {
 	flag.UintVar(&ePort, "ep", 8888, "port number our external listener listens on")
 	flag.StringVar(&eCName, "ecn", "localhost", "common name of external listening address")
 
+	flag.StringVar(&gAddr, "ga", "0.0.0.0", "address the proxy's gcp-external listener listens on")
+	flag.UintVar(&gPort, "gp", 9999, "port number our gcp-external listener listens on, 0 disables it")
+	flag.StringVar(&gCName, "gcn", "localhost", "common name of gcp-external listening address")
+
+	flag.StringVar(&rateLimitCounts, "ratelimit-counts", "5,10", "comma separated counts the rate limit service has rules for, rate limits keyed on client-ip or api-key can only use these")
+	flag.StringVar(&rateLimitService, "ratelimit-service", "", "host:port of a global rate limit service (grpc), needed for rate limits keyed on client-ip or api-key")
+	flag.StringVar(&regions, "regions", "", "comma separated endpoint regions in order of preference, the first being the local datacenter")
+	flag.StringVar(&headersFile, "headers", "", "path to file with request and response headers to add, set or remove on each listener")
+	flag.StringVar(&groupsHeader, "groups-header", "x-user-groups", "trusted header listing the caller's groups, leave empty to disable group checks")
+	flag.StringVar(&groupsTrusted, "groups-trusted-cidrs", "", "comma separated address ranges (e.g. an auth layer) allowed to set the groups header, it's removed from everyone else's requests")
+
+	flag.StringVar(&upstreamCa, "upstream-ca", "/etc/ssl/certs/ca-certificates.crt", "path to ca bundle https backends are verified against (defaults to the system bundle)")
+	flag.StringVar(&upstreamCert, "upstream-cert", "", "path to client certificate presented to https backends")
+	flag.StringVar(&upstreamKey, "upstream-key", "", "path to private key of the upstream client certificate")
+
 	// initialize directory watcher
 	change = make(chan watcher.Message)
+	batches = make(chan []watcher.Message)
 
 	// initialize termination handler
 	gracefulTermination = make(chan os.Signal, 1)
@@ -66,29 +110,84 @@ func main() {
 		ExternalAddress:    eAddr,
 		ExternalPort:       ePort,
 		ExternalCommonName: eCName,
+		GcpAddress:         gAddr,
+		GcpPort:            gPort,
+		GcpCommonName:      gCName,
+		GroupsHeader:       groupsHeader,
+		RateLimitService:   rateLimitService,
+		UpstreamTls: univcfg.UpstreamTls{
+			CaFile:   upstreamCa,
+			CertFile: upstreamCert,
+			KeyFile:  upstreamKey,
+		},
+	}
+	if (upstreamCert == "") != (upstreamKey == "") {
+		panic(fmt.Errorf("-upstream-cert and -upstream-key have to be set together"))
+	}
+	if groupsTrusted != "" {
+		for _, cidr := range strings.Split(groupsTrusted, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				panic(fmt.Errorf("invalid -groups-trusted-cidrs: %+v", err))
+			}
+			listenerInfo.GroupsTrustedCidrs = append(listenerInfo.GroupsTrustedCidrs, cidr)
+		}
+	}
+	if rateLimitService != "" {
+		if _, err := prxycfg.MakeRateLimitCluster(rateLimitService); err != nil {
+			panic(err)
+		}
+		for _, count := range strings.Split(rateLimitCounts, ",") {
+			value, err := strconv.ParseUint(strings.TrimSpace(count), 10, 32)
+			if err != nil || value == 0 {
+				panic(fmt.Errorf("invalid -ratelimit-counts: %q", rateLimitCounts))
+			}
+			listenerInfo.RateLimitCounts = append(listenerInfo.RateLimitCounts, uint(value))
+		}
+	}
+	if headersFile != "" {
+		headerRules, err := parser.ParseListenerHeaders(headersFile)
+		if err != nil {
+			panic(fmt.Errorf("error reading listener headers: %+v\n", err))
+		}
+		listenerInfo.HeaderRules = headerRules
 	}
 	envoy = processor.NewProcessor("envoy-instance", addHttp, listenerInfo)
+	if regions != "" {
+		regionList, err := processor.ParseRegions(regions)
+		if err != nil {
+			panic(fmt.Errorf("invalid -regions: %+v", err))
+		}
+		envoy.RegionPriority = processor.RegionPriorities(regionList)
+	}
+	envoy.Env = env
+	if conflicts != "newer" && conflicts != "both" {
+		panic(fmt.Errorf("invalid conflict policy: %s", conflicts))
+	}
+	envoy.ConflictPolicy = conflicts
 	// remove leading "./"
 	if directory[:2] == "./" {
 		directory = directory[2:]
 	}
 
 	// send existing databag files to envoy
+	// bad databags are quarantined, everything else still gets served
 	err := envoy.Process(watcher.Message{
 		Operation: watcher.Create,
 		Path:      directory,
 	})
 	if err != nil {
-		err = fmt.Errorf("error processing config: %+v\n", err)
-		panic(err)
+		fmt.Printf("error processing config: %+v\n", err)
 	}
 	envoy.Cache.GetSnapshot("envoy-instance")
 	prnt.EnvoyPrint(envoy.Configs)
+	printQuarantined()
 
 	// watch for file changes in specified directory
 	go func() {
 		watcher.Watch(directory, change)
 	}()
+	go watcher.Debounce(change, batches, debounce)
 
 	// run xds server to send cache updates
 	go func() {
@@ -97,16 +196,16 @@ func main() {
 	}()
 
 	// listen on directory for updates
-	// when change is made, process the change and send new snapshot
+	// when changes are made, process them and send a single new snapshot
 	for {
 		select {
-		case msg := <-change:
-			err := envoy.Process(msg)
+		case msgs := <-batches:
+			err := envoy.ProcessBatch(msgs)
 			if err != nil {
-				err = fmt.Errorf("error processing new config: %+v\n", err)
-				panic(err)
+				fmt.Printf("error processing new config: %+v\n", err)
 			}
 			prnt.EnvoyPrint(envoy.Configs)
+			printQuarantined()
 		case _ = <-gracefulTermination:
 			fmt.Printf("\nemptying configuration...\n")
 			envoy.ClearConfig()
@@ -116,3 +215,10 @@ func main() {
 		}
 	}
 }
+
+// list the databag files whose latest version was rejected (envoy keeps getting their last good config) or that lost a conflict
+func printQuarantined() {
+	for _, file := range envoy.QuarantinedFiles() {
+		fmt.Printf("quarantined: %s\n  %s\n", file.Path, strings.ReplaceAll(file.Reason, "\n", "\n  "))
+	}
+}
@@ -11,7 +11,11 @@ FLAGS=$(
     -icn $INTERNAL_CNAME \
     -ea $EXTERNAL_ADDRESS \
     -ep $EXTERNAL_PORT \
-    -ecn $EXTERNAL_CNAME"
+    -ecn $EXTERNAL_CNAME \
+    -ga $GCP_EXTERNAL_ADDRESS \
+    -gp $GCP_EXTERNAL_PORT \
+    -gcn $GCP_EXTERNAL_CNAME \
+    ${RATELIMIT_SERVICE:+-ratelimit-service $RATELIMIT_SERVICE}"
   )
 
 tmux new-session -d "envoy -c bootstrap/local.yml"